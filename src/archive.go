@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Default archive limits, applied when the endpoint config omits them
+const (
+	defaultArchiveMaxUncompressedSize = 256 << 20
+	defaultArchiveMaxEntrySize        = 128 << 20
+	defaultArchiveMaxCompressionRatio = 100
+	defaultArchiveMaxEntries          = 1000
+	defaultArchiveMaxDepth            = 8
+	defaultArchiveMaxPathLength       = 255
+)
+
+// Log files of the archive pushed by default
+var defaultArchiveEntries = []string{"*Verbose.log"}
+
+// ArchiveLimits protects from zip bombs and abusive archives
+type ArchiveLimits struct {
+	MaxUncompressedSize int64
+	MaxEntrySize        int64
+	MaxCompressionRatio float64
+	MaxEntries          int
+	MaxDepth            int
+	MaxPathLength       int
+}
+
+// ArchiveLimitError archive violates one of the limits, Status is the HTTP status for the client
+type ArchiveLimitError struct {
+	Status  int
+	Message string
+}
+
+func (err *ArchiveLimitError) Error() string {
+	return err.Message
+}
+
+func archiveTooLarge(format string, args ...interface{}) *ArchiveLimitError {
+	return &ArchiveLimitError{http.StatusRequestEntityTooLarge, fmt.Sprintf(format, args...)}
+}
+
+func archiveUnprocessable(format string, args ...interface{}) *ArchiveLimitError {
+	return &ArchiveLimitError{http.StatusUnprocessableEntity, fmt.Sprintf(format, args...)}
+}
+
+// NewArchiveLimits limits from parser config with defaults for omitted values
+func NewArchiveLimits(parserConfig ConfigParser) ArchiveLimits {
+	limits := ArchiveLimits{
+		MaxUncompressedSize: parserConfig.ArchiveMaxUncompressedSize,
+		MaxEntrySize:        parserConfig.ArchiveMaxEntrySize,
+		MaxCompressionRatio: parserConfig.ArchiveMaxCompressionRatio,
+		MaxEntries:          parserConfig.ArchiveMaxEntries,
+		MaxDepth:            parserConfig.ArchiveMaxDepth,
+		MaxPathLength:       parserConfig.ArchiveMaxPathLength,
+	}
+	if limits.MaxUncompressedSize <= 0 {
+		limits.MaxUncompressedSize = defaultArchiveMaxUncompressedSize
+	}
+	if limits.MaxEntrySize <= 0 {
+		limits.MaxEntrySize = defaultArchiveMaxEntrySize
+	}
+	if limits.MaxCompressionRatio <= 0 {
+		limits.MaxCompressionRatio = defaultArchiveMaxCompressionRatio
+	}
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = defaultArchiveMaxEntries
+	}
+	if limits.MaxDepth <= 0 {
+		limits.MaxDepth = defaultArchiveMaxDepth
+	}
+	if limits.MaxPathLength <= 0 {
+		limits.MaxPathLength = defaultArchiveMaxPathLength
+	}
+	return limits
+}
+
+// Check validates the archive directory before any entry is unpacked.
+// Declared sizes come from the archive itself, so Open enforces the limits again while reading.
+func (limits *ArchiveLimits) Check(zipReader *zip.Reader) error {
+	if len(zipReader.File) > limits.MaxEntries {
+		return archiveUnprocessable("archive has %d entries, limit is %d", len(zipReader.File), limits.MaxEntries)
+	}
+	var totalSize uint64
+	for _, packedFile := range zipReader.File {
+		name := packedFile.Name
+		if len(name) > limits.MaxPathLength {
+			return archiveUnprocessable("entry path %.64q... is longer than %d", name, limits.MaxPathLength)
+		}
+		if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || path.Clean("/"+name) != "/"+strings.TrimSuffix(name, "/") {
+			return archiveUnprocessable("entry path %q is not allowed", name)
+		}
+		if depth := strings.Count(strings.TrimSuffix(name, "/"), "/"); depth > limits.MaxDepth {
+			return archiveUnprocessable("entry %q is nested %d levels deep, limit is %d", name, depth, limits.MaxDepth)
+		}
+		if packedFile.UncompressedSize64 > uint64(limits.MaxEntrySize) {
+			return archiveTooLarge("entry %q uncompressed size %d exceeds %d", name, packedFile.UncompressedSize64, limits.MaxEntrySize)
+		}
+		if packedFile.CompressedSize64 > 0 && float64(packedFile.UncompressedSize64)/float64(packedFile.CompressedSize64) > limits.MaxCompressionRatio {
+			return archiveUnprocessable("entry %q compression ratio exceeds %v", name, limits.MaxCompressionRatio)
+		}
+		totalSize += packedFile.UncompressedSize64
+		if totalSize > uint64(limits.MaxUncompressedSize) {
+			return archiveTooLarge("archive uncompressed size exceeds %d", limits.MaxUncompressedSize)
+		}
+	}
+	return nil
+}
+
+// Open opens the archive entry, the reader fails with *ArchiveLimitError when the actual
+// unpacked content exceeds the entry size, the compression ratio or the remaining total size
+func (limits *ArchiveLimits) Open(packedFile *zip.File, totalRead *int64) (io.ReadCloser, error) {
+	readCloser, err := packedFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	maxSize := limits.MaxEntrySize
+	if ratioSize := int64(float64(packedFile.CompressedSize64) * limits.MaxCompressionRatio); packedFile.CompressedSize64 > 0 && ratioSize < maxSize {
+		maxSize = ratioSize
+	}
+	return &limitedEntryReader{
+		ReadCloser: readCloser,
+		name:       packedFile.Name,
+		limits:     limits,
+		maxSize:    maxSize,
+		totalRead:  totalRead,
+	}, nil
+}
+
+type limitedEntryReader struct {
+	io.ReadCloser
+	name      string
+	limits    *ArchiveLimits
+	maxSize   int64
+	read      int64
+	totalRead *int64
+}
+
+func (reader *limitedEntryReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.read += int64(n)
+	*reader.totalRead += int64(n)
+	if reader.read > reader.maxSize {
+		return n, archiveTooLarge("entry %q unpacked content exceeds %d bytes", reader.name, reader.maxSize)
+	}
+	if *reader.totalRead > reader.limits.MaxUncompressedSize {
+		return n, archiveTooLarge("archive uncompressed size exceeds %d", reader.limits.MaxUncompressedSize)
+	}
+	return n, err
+}
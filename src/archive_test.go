@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name    string
+	content string
+}
+
+// testZip archive of the entries, deflated
+func testZip(t *testing.T, entries ...testEntry) *zip.Reader {
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	for _, entry := range entries {
+		writer, err := zipWriter.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(writer, entry.content)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zipReader
+}
+
+func TestArchiveLimitsCheck(t *testing.T) {
+	line := "00:09:58:068__FINE_____SplitLogger |***File handlers initialized\n"
+	manyEntries := make([]testEntry, 4)
+	for i := range manyEntries {
+		manyEntries[i] = testEntry{name: strings.Repeat("d/", i) + "Verbose.log", content: line}
+	}
+	for _, test := range []struct {
+		name    string
+		parser  ConfigParser
+		entries []testEntry
+		status  int
+		message string
+	}{
+		{name: "within limits", parser: ConfigParser{ArchiveMaxEntries: 4, ArchiveMaxDepth: 3}, entries: manyEntries},
+		{name: "entry count", parser: ConfigParser{ArchiveMaxEntries: 3}, entries: manyEntries,
+			status: http.StatusUnprocessableEntity, message: "archive has 4 entries, limit is 3"},
+		{name: "total size", parser: ConfigParser{ArchiveMaxUncompressedSize: 100},
+			entries: []testEntry{{"a/Verbose.log", line}, {"b/Verbose.log", line}},
+			status:  http.StatusRequestEntityTooLarge, message: "archive uncompressed size exceeds 100"},
+		{name: "entry size", parser: ConfigParser{ArchiveMaxEntrySize: 64},
+			entries: []testEntry{{"Verbose.log", line}},
+			status:  http.StatusRequestEntityTooLarge, message: `entry "Verbose.log" uncompressed size 65 exceeds 64`},
+		{name: "depth", parser: ConfigParser{ArchiveMaxDepth: 2}, entries: manyEntries,
+			status: http.StatusUnprocessableEntity, message: `entry "d/d/d/Verbose.log" is nested 3 levels deep, limit is 2`},
+		{name: "compression ratio", entries: []testEntry{{"Verbose.log", strings.Repeat("\x00", 1<<20)}},
+			status: http.StatusUnprocessableEntity, message: `entry "Verbose.log" compression ratio exceeds 100`},
+		{name: "path length", parser: ConfigParser{ArchiveMaxPathLength: 16}, entries: []testEntry{{"logs/2023/12/Verbose.log", line}},
+			status: http.StatusUnprocessableEntity, message: "is longer than 16"},
+		{name: "traversal", entries: []testEntry{{"../Verbose.log", line}},
+			status: http.StatusUnprocessableEntity, message: `entry path "../Verbose.log" is not allowed`},
+	} {
+		limits := NewArchiveLimits(test.parser)
+		err := limits.Check(testZip(t, test.entries...))
+		if test.status == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		var limitError *ArchiveLimitError
+		if !errors.As(err, &limitError) || limitError.Status != test.status || !strings.Contains(limitError.Message, test.message) {
+			t.Errorf("%s: error %v, want %d %s", test.name, err, test.status, test.message)
+		}
+	}
+}
+
+func TestArchiveLimitsOpen(t *testing.T) {
+	// declared sizes pass Check, Open limits what is actually unpacked
+	zipReader := testZip(t, testEntry{"a/Verbose.log", strings.Repeat("a", 600)}, testEntry{"b/Verbose.log", strings.Repeat("b", 600)})
+	limits := NewArchiveLimits(ConfigParser{ArchiveMaxEntrySize: 500})
+	var totalRead int64
+	reader, err := limits.Open(zipReader.File[0], &totalRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	var limitError *ArchiveLimitError
+	if !errors.As(err, &limitError) || limitError.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("entry size: error %v", err)
+	}
+
+	limits = NewArchiveLimits(ConfigParser{ArchiveMaxUncompressedSize: 1000})
+	totalRead = 0
+	for i, packedFile := range zipReader.File {
+		reader, err := limits.Open(packedFile, &totalRead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(reader)
+		reader.Close()
+		if i == 0 && err != nil {
+			t.Fatalf("first entry: %v", err)
+		}
+		if i == 1 && (!errors.As(err, &limitError) || !strings.Contains(limitError.Message, "archive uncompressed size exceeds 1000")) {
+			t.Fatalf("total size: error %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where the client passes the API key by default
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultAPIKeyQuery  = "api_key"
+)
+
+var errMissingCredentials = errors.New("credentials are required")
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// ConfigAPIKey API key YAML, the key is inline, in a file or in an environment variable
+type ConfigAPIKey struct {
+	Name    string            `yaml:"name"`
+	Key     string            `yaml:"key,omitempty"`
+	KeyFile string            `yaml:"key.file,omitempty"`
+	KeyEnv  string            `yaml:"key.env,omitempty"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// APIKey accepted key of the upload endpoint, only hash of the key is kept
+type APIKey struct {
+	Name   string
+	Hash   [sha256.Size]byte
+	Labels map[string]string
+}
+
+// Principal authenticated client of the upload, its labels can't be overridden by the client,
+// not zero MaxUploadSize lowers the upload size limit of the endpoint, not empty Tenant is the Loki tenant of the pushes
+type Principal struct {
+	Name          string
+	Labels        map[string]string
+	MaxUploadSize int64
+	Tenant        string
+}
+
+// NewAPIKey loads the key from its source
+func NewAPIKey(keyConfig ConfigAPIKey) (*APIKey, error) {
+	key := keyConfig.Key
+	switch {
+	case keyConfig.KeyFile != "":
+		content, err := os.ReadFile(keyConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read key.file of API key [%s]: %v", keyConfig.Name, err)
+		}
+		key = strings.TrimSpace(string(content))
+	case keyConfig.KeyEnv != "":
+		key = os.Getenv(keyConfig.KeyEnv)
+	}
+	if key == "" {
+		return nil, fmt.Errorf("API key [%s] is empty", keyConfig.Name)
+	}
+	if err := checkLabelNames(keyConfig.Labels); err != nil {
+		return nil, fmt.Errorf("labels of API key [%s]: %v", keyConfig.Name, err)
+	}
+	return &APIKey{
+		Name:   keyConfig.Name,
+		Hash:   sha256.Sum256([]byte(key)),
+		Labels: keyConfig.Labels,
+	}, nil
+}
+
+// clientIP address of the client without port
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// authenticate checks credentials of the upload request (signed URL, bearer token or API key), nil principal means the endpoint is open.
+// Credential query parameters are removed from the request so they never become labels.
+func (promtailConfig *MoLogPromtail) authenticate(request *http.Request) (*Principal, error) {
+	query := request.URL.Query()
+	if len(promtailConfig.SignedURLSecret) > 0 && query.Has(signedURLSignature) {
+		principal, err := verifySignedURL(promtailConfig.SignedURLSecret, request.URL.Path, query, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		query.Del(signedURLSignature)
+		query.Del(signedURLExpires)
+		query.Del(signedURLMaxSize)
+		request.URL.RawQuery = query.Encode()
+		return principal, nil
+	}
+	if promtailConfig.JWT != nil {
+		if token, exists := bearerToken(request); exists {
+			return promtailConfig.JWT.Authenticate(token, time.Now())
+		}
+	}
+	if len(promtailConfig.APIKeys) == 0 {
+		if len(promtailConfig.SignedURLSecret) > 0 || promtailConfig.JWT != nil {
+			return nil, errMissingCredentials
+		}
+		return nil, nil
+	}
+	key := request.Header.Get(promtailConfig.APIKeyHeader)
+	if queryKey := query.Get(promtailConfig.APIKeyQuery); queryKey != "" {
+		if key == "" {
+			key = queryKey
+		}
+		query.Del(promtailConfig.APIKeyQuery)
+		request.URL.RawQuery = query.Encode()
+	}
+	if key == "" {
+		return nil, errMissingCredentials
+	}
+	hash := sha256.Sum256([]byte(key))
+	for _, apiKey := range promtailConfig.APIKeys {
+		if subtle.ConstantTimeCompare(hash[:], apiKey.Hash[:]) == 1 {
+			return &Principal{Name: apiKey.Name, Labels: apiKey.Labels}, nil
+		}
+	}
+	return nil, errInvalidCredentials
+}
+
+// authenticationFailed counts and logs the failed attempt and answers 401
+func authenticationFailed(responseWriter http.ResponseWriter, request *http.Request, err error) {
+	reason := "invalid"
+	if errors.Is(err, errMissingCredentials) {
+		reason = "missing"
+	} else if errors.Is(err, errSignedURLExpired) || errors.Is(err, errJWTExpired) {
+		reason = "expired"
+	} else if errors.Is(err, errClientCertificate) {
+		reason = "certificate"
+	}
+	metrics.authFailures.Add(1, request.URL.Path, reason)
+	log.Printf("[WARN] Authentication failed for %v from %v: %v", request.URL.Path, clientIP(request), err)
+	writeJSONError(responseWriter, http.StatusUnauthorized, err.Error())
+}
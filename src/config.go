@@ -4,142 +4,758 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"reflect"
+	"regexp"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-const initConfig = `schema.version: "1.0"
-endpoint.upload: /api/v1
-# tls.cert.file: my-domain.crt
-# tls.key.file: my-domain.key
-promtail.to.endpoint:
-  - promtail.client.config:
-      # FIXME: https://github.com/edenhill/librdredis/blob/master/CONFIGURATION.md#global-configuration-properties
+const initConfig = `schema.version: "2.0"
+# string values may reference environment variables ${NAME} or ${NAME:-default} and secret files file:/run/secrets/name,
+# values of secret keys are redacted in the log. Files of schema 1.0 are still loaded, molog migrate-config upgrades them.
+# files, glob patterns or directories (conf.d) relative to this file, their sinks, parsers and listeners are added,
+# endpoints of the same address are served by one listener
+# include: [conf.d]
+# storage:
+#   # directory for the processed uploads and other state
+#   dir: data
+#   # retried uploads with the same content or Idempotency-Key header are not ingested again during this time
+#   idempotency.ttl: 24h
+#   # pushes promtail didn't accept are kept in the spool (default storage dir/spool) and replayed
+#   spool.dir: data/spool
+#   spool.max.size: 268435456
+# on SIGINT/SIGTERM in-flight uploads may finish during this time, lines not pushed by then are spooled
+# shutdown.timeout: 30s
+sinks:
+  loki:
+    - name: loki
       url: http://promtail:3500/loki/api/v1/push
-	address: :8804
-	# promtail.default.label: label1
-	# default maximum upload size is 10M
-	max.upload.size: 10485760
+      # readiness probe, default is /ready next to the push url
+      # ready.url: http://promtail:3500/ready
+  # buckets probed by the readiness endpoint
+  # s3:
+  #   - name: archive
+  #     endpoint: minio:9000
+  #     bucket: molog
+  #     access.key.id: ${S3_ACCESS_KEY_ID}
+  #     secret.access.key: file:/run/secrets/s3_secret_access_key
+  #     use.ssl: false
+# endpoints refer to a parser by name, endpoints without one use the defaults
+# parsers:
+#   - name: android
+#     # named groups year, month, day, hour, minute, second, millisecond give the base date/time,
+#     # any other named group becomes a label
+#     filename.pattern: ^(?P<month>\d{2})\.(?P<day>\d{2})\.(?P<year>\d{2})_(?P<hour>\d{2})\.(?P<minute>\d{2})\.(?P<second>\d{2})
+#     # log files of the archive to push, glob patterns for the entry path or file name
+#     archive.entries: ["*Verbose.log"]
+#     # skip lines already pushed by earlier uploads of the same device (same labels),
+#     # the window is the number of hashes of the last pushed lines kept per device
+#     dedup.device: true
+#     dedup.window: 10000
+#     # push identical records (timestamp, level, tag, message) found in several log files of the archive once
+#     dedup.archive: true
+#     # zip bomb protection, defaults are shown
+#     archive.max.uncompressed.size: 268435456
+#     archive.max.entry.size: 134217728
+#     archive.max.compression.ratio: 100
+#     archive.max.entries: 1000
+#     archive.max.depth: 8
+#     archive.max.path.length: 255
+listeners:
+  - address: :8804
+    # liveness, readiness and Prometheus metrics endpoints of the address, defaults are shown
+    # endpoint.health: /healthz
+    # endpoint.ready: /readyz
+    # endpoint.metrics: /metrics
+    # default maximum upload size is 10M
+    max.upload.size: 10485760
+    # behind a load balancer the client address (client.ip, rate.limit.key ip) is taken from X-Forwarded-For
+    # of requests of these proxies (CIDR or address), without the list the address of the peer is used
+    # trusted.proxies: [10.0.0.0/8]
+    # HTTPS of the listener, certificates are selected by the server name (SNI), cert.file and key.file
+    # is used when no other one matches, certificate files are reloaded when they change
+    # tls:
+    #   cert.file: my-domain.crt
+    #   key.file: my-domain.key
+    #   certificates:
+    #     - cert.file: other-domain.crt
+    #       key.file: other-domain.key
+    #   # 1.0, 1.1, 1.2 (default) or 1.3, cipher suites of TLS 1.2 and lower, Go defaults when omitted
+    #   min.version: "1.2"
+    #   cipher.suites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+    #   # clients must present a certificate of the CA (client.auth: require or optional),
+    #   # labels are taken from the verified certificate: cn, san.dns, san.email, san.uri, san.ip or extension OID
+    #   client.ca.file: devices-ca.crt
+    #   client.auth: require
+    #   client.labels:
+    #     device_id: cn
+    endpoints:
+      - endpoint.upload: /api/v1
+        # endpoint.test: /test
+        # loki sink of the pushes, may be omitted when there is only one
+        sink: loki
+        # parser: android
+        # labels of all pushes of the endpoint, values take {filename.<group>} of the filename.pattern,
+        # {header.<name>}, {client.ip} and {upload.id}, labels with an empty value are left out.
+        # Labels with {client.ip} or {upload.id} differ per upload, they don't identify the device of dedup.device.
+        # Precedence: query parameters < filename groups < endpoint labels < labels of the authenticated client
+        # labels:
+        #   env: prod
+        #   app: field-service
+        #   build: "{header.X-App-Build}"
+        # accepted query parameters, without the list every parameter becomes a label. Unknown parameters,
+        # missing required ones and values not matching the pattern (whole value) or enum are rejected with 400.
+        # target is label (default), metadata (structured metadata of the lines) or drop
+        # query.params:
+        #   - name: device_id
+        #     required: true
+        #     pattern: "[a-zA-Z0-9-]{1,64}"
+        #   - name: env
+        #     enum: [prod, staging]
+        #   - name: session
+        #     target: metadata
+        #   - name: cache_buster
+        #     target: drop
+        # uploads require one of the API keys (inline, key.file or key.env) in the header or the query parameter,
+        # labels of the key can't be overridden by the client
+        # auth.api.key.header: X-API-Key
+        # auth.api.key.query: api_key
+        # auth.api.keys:
+        #   - name: crm
+        #     key.env: CRM_API_KEY
+        #     labels:
+        #       app: crm
+        # uploads with URLs signed by the shared secret (HMAC-SHA256 over path, expires, max_size and labels),
+        # see molog -sign-url
+        # auth.signed.url.secret.env: MOLOG_SIGNING_SECRET
+        # uploads with OAuth access token (Authorization: Bearer) signed by a key of the JWKS (RS256, ES256, EdDSA),
+        # claims are mapped to labels, tenant.claim gives the Loki tenant (X-Scope-OrgID)
+        # auth.jwt:
+        #   jwks.url: https://auth.example.com/.well-known/jwks.json
+        #   issuer: https://auth.example.com/
+        #   audience: molog
+        #   claims:
+        #     user: sub
+        #   tenant.claim: tenant
+        # uploads (requests) and bytes per minute of the client (ip, principal or label:<name> of the authenticated client),
+        # and daily (UTC) quotas, exceeding them is answered with 429 and Retry-After
+        # rate.limit.key: label:employee
+        # rate.limit.requests: 10
+        # rate.limit.requests.burst: 20
+        # rate.limit.bytes: 104857600
+        # quota.daily.bytes: 1073741824
+        # quota.daily.lines: 10000000
 `
 
-// ConfigMoLog Redis to upload YAML
-type ConfigMoLog struct {
-	PromtailClientConfig map[string]interface{} `yaml:"promtail.client.config"`
-	Address              string                 `yaml:"address"`
-	MaxUploadSize        int64                  `yaml:"max.upload.size"`
-	EndpointPrefix       string                 `yaml:"endpoint.prefix"`
-	EndpointTest         string                 `yaml:"endpoint.test"`
-	EndpointUpload       string                 `yaml:"endpoint.upload"`
-	Compression          bool                   `yaml:"compression"`
-}
+const (
+	defaultAddress       = ":8804"
+	defaultMaxUploadSize = 10 << 20
+)
 
-// Config YAML config file
+// Config YAML config file of schema 2.0
 type Config struct {
-	SchemaVersion string        `yaml:"schema.version"`
-	TLSCertFile   string        `yaml:"tls.cert.file"`
-	TLSKeyFile    string        `yaml:"tls.key.file"`
-	ConfigMoLogs  []ConfigMoLog `yaml:"promtail.to.endpoint"`
+	SchemaVersion   string           `yaml:"schema.version"`
+	Include         []string         `yaml:"include,omitempty"`
+	Storage         ConfigStorage    `yaml:"storage,omitempty"`
+	ShutdownTimeout time.Duration    `yaml:"shutdown.timeout,omitempty"`
+	Sinks           ConfigSinks      `yaml:"sinks"`
+	Parsers         []ConfigParser   `yaml:"parsers,omitempty"`
+	Listeners       []ConfigListener `yaml:"listeners"`
+}
+
+// ConfigStorage state directories shared by all listeners
+type ConfigStorage struct {
+	Dir            string        `yaml:"dir,omitempty"`
+	IdempotencyTTL time.Duration `yaml:"idempotency.ttl,omitempty"`
+	SpoolDir       string        `yaml:"spool.dir,omitempty"`
+	SpoolMaxSize   int64         `yaml:"spool.max.size,omitempty"`
+}
+
+// ConfigTLS server certificates and client authentication of the listener,
+// certificates are selected by the server name (SNI), cert.file and key.file is the default one
+type ConfigTLS struct {
+	CertFile     string              `yaml:"cert.file,omitempty"`
+	KeyFile      string              `yaml:"key.file,omitempty"`
+	Certificates []ConfigCertificate `yaml:"certificates,omitempty"`
+	MinVersion   string              `yaml:"min.version,omitempty"`
+	CipherSuites []string            `yaml:"cipher.suites,omitempty"`
+	ClientCAFile string              `yaml:"client.ca.file,omitempty"`
+	ClientAuth   string              `yaml:"client.auth,omitempty"`
+	ClientLabels map[string]string   `yaml:"client.labels,omitempty"`
+}
+
+// ConfigCertificate certificate and key files, reloaded when they change
+type ConfigCertificate struct {
+	CertFile string `yaml:"cert.file"`
+	KeyFile  string `yaml:"key.file"`
+}
+
+// ConfigSinks destinations of the uploads, referred by name
+type ConfigSinks struct {
+	Loki []ConfigLokiSink `yaml:"loki"`
+	S3   []ConfigS3Sink   `yaml:"s3,omitempty"`
+}
+
+// ConfigLokiSink Loki (promtail) push API
+type ConfigLokiSink struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	ReadyURL string `yaml:"ready.url,omitempty"`
+}
+
+// ConfigS3Sink S3 object storage bucket
+type ConfigS3Sink struct {
+	Name            string `yaml:"name"`
+	Endpoint        string `yaml:"endpoint"`
+	Bucket          string `yaml:"bucket,omitempty"`
+	Region          string `yaml:"region,omitempty"`
+	AccessKeyID     string `yaml:"access.key.id,omitempty"`
+	SecretAccessKey string `yaml:"secret.access.key,omitempty"`
+	UseSSL          bool   `yaml:"use.ssl,omitempty"`
+}
+
+// ConfigParser how the log files of uploaded archives are selected, parsed and deduplicated
+type ConfigParser struct {
+	Name            string   `yaml:"name"`
+	FilenamePattern string   `yaml:"filename.pattern,omitempty"`
+	ArchiveEntries  []string `yaml:"archive.entries,omitempty"`
+	DedupDevice     bool     `yaml:"dedup.device,omitempty"`
+	DedupWindow     int      `yaml:"dedup.window,omitempty"`
+	DedupArchive    bool     `yaml:"dedup.archive,omitempty"`
+
+	ArchiveMaxUncompressedSize int64   `yaml:"archive.max.uncompressed.size,omitempty"`
+	ArchiveMaxEntrySize        int64   `yaml:"archive.max.entry.size,omitempty"`
+	ArchiveMaxCompressionRatio float64 `yaml:"archive.max.compression.ratio,omitempty"`
+	ArchiveMaxEntries          int     `yaml:"archive.max.entries,omitempty"`
+	ArchiveMaxDepth            int     `yaml:"archive.max.depth,omitempty"`
+	ArchiveMaxPathLength       int     `yaml:"archive.max.path.length,omitempty"`
+}
+
+// ConfigListener address with its service endpoints and upload endpoints
+type ConfigListener struct {
+	Address         string           `yaml:"address,omitempty"`
+	EndpointHealth  string           `yaml:"endpoint.health,omitempty"`
+	EndpointReady   string           `yaml:"endpoint.ready,omitempty"`
+	EndpointMetrics string           `yaml:"endpoint.metrics,omitempty"`
+	MaxUploadSize   int64            `yaml:"max.upload.size,omitempty"`
+	TrustedProxies  []string         `yaml:"trusted.proxies,omitempty"`
+	TLS             *ConfigTLS       `yaml:"tls,omitempty"`
+	Endpoints       []ConfigEndpoint `yaml:"endpoints"`
+}
+
+// ConfigEndpoint upload and test UI paths, pushed to the sink after parsing by the parser
+type ConfigEndpoint struct {
+	EndpointPrefix          string             `yaml:"endpoint.prefix,omitempty"`
+	EndpointTest            string             `yaml:"endpoint.test,omitempty"`
+	EndpointUpload          string             `yaml:"endpoint.upload,omitempty"`
+	Sink                    string             `yaml:"sink,omitempty"`
+	Parser                  string             `yaml:"parser,omitempty"`
+	Labels                  map[string]string  `yaml:"labels,omitempty"`
+	QueryParams             []ConfigQueryParam `yaml:"query.params,omitempty"`
+	AuthAPIKeys             []ConfigAPIKey     `yaml:"auth.api.keys,omitempty"`
+	AuthAPIKeyHeader        string             `yaml:"auth.api.key.header,omitempty"`
+	AuthAPIKeyQuery         string             `yaml:"auth.api.key.query,omitempty"`
+	AuthSignedURLSecret     string             `yaml:"auth.signed.url.secret,omitempty"`
+	AuthSignedURLSecretFile string             `yaml:"auth.signed.url.secret.file,omitempty"`
+	AuthSignedURLSecretEnv  string             `yaml:"auth.signed.url.secret.env,omitempty"`
+	AuthJWT                 *ConfigJWT         `yaml:"auth.jwt,omitempty"`
+
+	RateLimitKey           string  `yaml:"rate.limit.key,omitempty"`
+	RateLimitRequests      float64 `yaml:"rate.limit.requests,omitempty"`
+	RateLimitRequestsBurst int     `yaml:"rate.limit.requests.burst,omitempty"`
+	RateLimitBytes         int64   `yaml:"rate.limit.bytes,omitempty"`
+	RateLimitBytesBurst    int64   `yaml:"rate.limit.bytes.burst,omitempty"`
+	QuotaDailyBytes        int64   `yaml:"quota.daily.bytes,omitempty"`
+	QuotaDailyLines        int64   `yaml:"quota.daily.lines,omitempty"`
+}
+
+// endpointParser compiled parser config
+type endpointParser struct {
+	config          ConfigParser
+	filenamePattern *regexp.Regexp
+	archiveEntries  []string
 }
 
-// ReadMoLog read config file and returns collection of MoLog
+// ReadMoLog read config file and returns collection of MoLog, invalid config stops the process
 func ReadMoLog(filename string) []*MoLog {
-	fileContent, err := os.ReadFile(filename)
+	moLogs, err := LoadMoLog(filename)
 	if err != nil {
-		absPath, _ := filepath.Abs(filename)
-		log.Fatalf("Error while reading %v file: \n%v ", absPath, err)
+		log.Fatalf("Invalid config %v:\n%v", filename, err)
+	}
+	return moLogs
+}
+
+// LoadMoLog read config file and returns collection of MoLog or all problems of the config (ConfigErrors)
+func LoadMoLog(filename string) ([]*MoLog, error) {
+	return loadMoLog(filename, true)
+}
+
+// decodeConfig decodes the config of any supported schema version, 1.0 is migrated to 2.0.
+// Files without schema.version have the default version. Errors are added to the checker,
+// the config is nil when the file can't be decoded. The schema version of the file is returned.
+func decodeConfig(fileContent []byte, checker *configChecker, defaultVersion string) (*Config, string) {
+	var header struct {
+		SchemaVersion string `yaml:"schema.version"`
+	}
+	if err := yaml.Unmarshal(fileContent, &header); err != nil {
+		checker.yamlError(err)
+		return nil, ""
 	}
-	log.Printf("%s\n%s", filename, string(fileContent))
-	var config Config
-	err = yaml.Unmarshal(fileContent, &config)
+	if header.SchemaVersion == "" {
+		header.SchemaVersion = defaultVersion
+	}
+	switch header.SchemaVersion {
+	case schemaVersion1:
+		var v1 ConfigV1
+		if err := yaml.Unmarshal(fileContent, &v1); err != nil {
+			checker.yamlError(err)
+			return nil, ""
+		}
+		return migrateConfig(v1, checker), schemaVersion1
+	case schemaVersion2:
+		// unknown keys are errors, 2.0 has no untyped sections
+		var config Config
+		if err := yaml.UnmarshalStrict(fileContent, &config); err != nil {
+			checker.yamlError(err)
+			return nil, ""
+		}
+		return &config, schemaVersion2
+	default:
+		checker.add([]interface{}{"schema.version"}, "unsupported schema version [%s], must be %s or %s", header.SchemaVersion, schemaVersion1, schemaVersion2)
+		return nil, ""
+	}
+}
+
+// compileParser validates the parser config and compiles its patterns, defaults are used for omitted values
+func compileParser(parserConfig ConfigParser, parserPath []interface{}, checker *configChecker) *endpointParser {
+	parser := &endpointParser{config: parserConfig}
+	at := func(key ...interface{}) []interface{} {
+		return append(parserPath[:len(parserPath):len(parserPath)], key...)
+	}
+	filenamePattern := parserConfig.FilenamePattern
+	if filenamePattern == "" {
+		filenamePattern = defaultFilenamePattern
+	}
+	var err error
+	if parser.filenamePattern, err = regexp.Compile(filenamePattern); err != nil {
+		checker.add(at("filename.pattern"), "invalid pattern: %v", err)
+	}
+	parser.archiveEntries = parserConfig.ArchiveEntries
+	if len(parser.archiveEntries) == 0 {
+		parser.archiveEntries = defaultArchiveEntries
+	}
+	for j, pattern := range parser.archiveEntries {
+		if _, err := path.Match(pattern, ""); err != nil {
+			checker.add(at("archive.entries", j), "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	for key, value := range map[string]float64{
+		"archive.max.uncompressed.size": float64(parserConfig.ArchiveMaxUncompressedSize),
+		"archive.max.entry.size":        float64(parserConfig.ArchiveMaxEntrySize),
+		"archive.max.compression.ratio": parserConfig.ArchiveMaxCompressionRatio,
+		"archive.max.entries":           float64(parserConfig.ArchiveMaxEntries),
+		"archive.max.depth":             float64(parserConfig.ArchiveMaxDepth),
+		"archive.max.path.length":       float64(parserConfig.ArchiveMaxPathLength),
+		"dedup.window":                  float64(parserConfig.DedupWindow),
+	} {
+		if value < 0 {
+			checker.add(at(key), "must not be negative")
+		}
+	}
+	return parser
+}
+
+// loadMoLog validates the config file and builds MoLog of every listener, stores are opened only with openStores
+func loadMoLog(filename string, openStores bool) ([]*MoLog, error) {
+	fileContent, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		absPath, _ := filepath.Abs(filename)
+		return nil, &ConfigError{File: absPath, Message: err.Error()}
 	}
+	return buildMoLog(filename, fileContent, openStores, nil)
+}
 
-	certFile := ""
-	keyFile := ""
-	if config.TLSCertFile != "" && config.TLSKeyFile == "" || config.TLSCertFile == "" && config.TLSKeyFile != "" {
-		panic(fmt.Sprintf("Both certificate and key file must be defined %v", "."))
-	} else if config.TLSCertFile != "" {
-		if _, err := os.Stat(config.TLSCertFile); err == nil {
-			if _, err := os.Stat(config.TLSKeyFile); err == nil {
-				keyFile = config.TLSKeyFile
-				certFile = config.TLSCertFile
-			} else {
-				panic(fmt.Sprintf("key file %s does not exist", config.TLSKeyFile))
-			}
-		} else {
-			panic(fmt.Sprintf("certificate file %s does not exist", config.TLSKeyFile))
+// buildMoLog validates the config content and builds MoLog of every listener, stores are opened (and set) only with openStores.
+// With pendingWarnings files the config refers to may not exist yet, the warnings of the config are returned there.
+func buildMoLog(filename string, fileContent []byte, openStores bool, pendingWarnings *[]string) ([]*MoLog, error) {
+	if openStores {
+		log.Printf("%s\n%s", filename, redactConfig(fileContent))
+	}
+	checker := newConfigChecker(filename, fileContent)
+	if pendingWarnings != nil {
+		checker.pendingFiles = true
+		defer func() { *pendingWarnings = checker.warnings }()
+	}
+	config, version := decodeConfig(fileContent, checker, schemaVersion1)
+	if config == nil {
+		return nil, checker.err()
+	}
+	configFiles := checker.include(config, filename, version)
+	if openStores {
+		if version == schemaVersion1 {
+			log.Printf("[WARN] Config %v has schema %s, upgrade it to %s with molog migrate-config", filename, schemaVersion1, schemaVersion2)
+		}
+		for _, warning := range checker.warnings {
+			log.Printf("[WARN] %v", warning)
 		}
 	}
-	moLogMap := make(map[string]*MoLog)
-	for _, moLogConfig := range config.ConfigMoLogs {
-		var moLog *MoLog
-		var exists bool
+	// ${ENV}, ${ENV:-default} and file: references in string values
+	checker.interpolate(reflect.ValueOf(config).Elem(), nil)
 
-		// Redefine default port to 8804
-		if moLogConfig.Address == "" {
-			moLogConfig.Address = ":8804"
+	var err error
+	storage := config.Storage
+	if storage.Dir == "" {
+		storage.Dir = defaultStorageDir
+	}
+	if storage.SpoolDir == "" {
+		storage.SpoolDir = filepath.Join(storage.Dir, "spool")
+	}
+	if storage.IdempotencyTTL < 0 {
+		checker.add([]interface{}{"storage", "idempotency.ttl"}, "must not be negative")
+	}
+	if storage.SpoolMaxSize < 0 {
+		checker.add([]interface{}{"storage", "spool.max.size"}, "must not be negative")
+	}
+	if config.ShutdownTimeout < 0 {
+		checker.add([]interface{}{"shutdown.timeout"}, "must not be negative")
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	// sink names are unique across the sink types
+	sinkNames := make(map[string][]interface{})
+	sinkName := func(name string, sinkPath []interface{}) {
+		if name == "" {
+			checker.add(append(sinkPath, "name"), "name must be defined")
+		} else if firstPath, exists := sinkNames[name]; exists {
+			checker.add(append(sinkPath, "name"), "sink [%s] already defined%s", name, checker.definedIn(firstPath, sinkPath))
+			return
+		}
+		sinkNames[name] = sinkPath
+	}
+	s3s := make([]*MoLogS3, 0, len(config.Sinks.S3))
+	for i, s3Config := range config.Sinks.S3 {
+		sinkName(s3Config.Name, []interface{}{"sinks", "s3", i})
+		s3, err := NewMoLogS3(s3Config)
+		if err != nil {
+			checker.add([]interface{}{"sinks", "s3", i}, "%v", err)
+			continue
+		}
+		s3s = append(s3s, s3)
+	}
+	lokiSinks := make(map[string]ConfigLokiSink)
+	for i, sink := range config.Sinks.Loki {
+		sinkName(sink.Name, []interface{}{"sinks", "loki", i})
+		if sink.URL == "" {
+			checker.add([]interface{}{"sinks", "loki", i, "url"}, "promtail url must be defined for sink [%s]", sink.Name)
 		}
+		lokiSinks[sink.Name] = sink
+	}
+	if len(config.Sinks.Loki) == 0 {
+		checker.add([]interface{}{"sinks", "loki"}, "at least one loki sink must be defined")
+	}
 
-		// Redefine default uploadPath to /api/v1
-		if moLogConfig.EndpointUpload == "" {
-			moLogConfig.EndpointUpload = "api/v1"
+	parsers := make(map[string]*endpointParser)
+	parserPaths := make(map[string][]interface{})
+	for i, parserConfig := range config.Parsers {
+		parserPath := []interface{}{"parsers", i}
+		if parserConfig.Name == "" {
+			checker.add(append(parserPath, "name"), "name must be defined")
+		} else if firstPath, exists := parserPaths[parserConfig.Name]; exists {
+			checker.add(append(parserPath, "name"), "parser [%s] already defined%s", parserConfig.Name, checker.definedIn(firstPath, parserPath))
+			continue
 		}
+		parserPaths[parserConfig.Name] = parserPath
+		parsers[parserConfig.Name] = compileParser(parserConfig, parserPath, checker)
+	}
+	defaultParser := compileParser(ConfigParser{}, nil, checker)
 
-		if moLog, exists = moLogMap[moLogConfig.Address]; !exists {
-			moLog = &MoLog{
-				Address:       moLogConfig.Address,
-				TLSCertFile:   certFile,
-				TLSKeyFile:    keyFile,
-				SourceFile:    filename,
-				Promtails:     make(map[string]*MoLogPromtail),
-				TestUIs:       make(map[string]*string),
-				MaxUploadSize: moLogConfig.MaxUploadSize,
-			}
-			moLogMap[moLogConfig.Address] = moLog
+	if len(config.Listeners) == 0 {
+		checker.add([]interface{}{"listeners"}, "at least one listener must be defined")
+	}
+	moLogMap := make(map[string]*MoLog)
+	// index of the listener of the address, service paths are reported there
+	addressIndex := make(map[string]int)
+	// endpoint of the test and upload paths by address, conflicts name the file of the other endpoint
+	pathEndpoints := make(map[string][]interface{})
+	for l, listenerConfig := range config.Listeners {
+		listenerPath := []interface{}{"listeners", l}
+		if listenerConfig.Address == "" {
+			listenerConfig.Address = defaultAddress
 		}
-		testPath := moLogConfig.EndpointTest
-		uploadPath := moLogConfig.EndpointUpload
-		if testPath == "" && uploadPath == "" {
-			testPath = "test"
+		if _, exists := moLogMap[listenerConfig.Address]; exists {
+			checker.add(append(listenerPath, "address"), "address [%s] already defined", listenerConfig.Address)
+			continue
 		}
-		if moLogConfig.EndpointPrefix != "" {
-			testPath = moLogConfig.EndpointPrefix + "/" + testPath
-			uploadPath = moLogConfig.EndpointPrefix + "/" + uploadPath
+
+		var listenerTLS *ListenerTLS
+		if listenerConfig.TLS != nil {
+			listenerTLS = newListenerTLS(*listenerConfig.TLS, append(listenerPath, "tls"), checker)
 		}
-		testPath = "/" + strings.TrimRight(testPath, "/")
-		uploadPath = "/" + strings.TrimRight(uploadPath, "/")
 
-		if testPath == uploadPath {
-			panic(fmt.Sprintf("test path and upload path can't be same [%s]", moLogConfig.EndpointTest))
+		// Redefine default maximum upload size to 10M
+		if listenerConfig.MaxUploadSize < 0 {
+			checker.add(append(listenerPath, "max.upload.size"), "must not be negative")
+		}
+		if listenerConfig.MaxUploadSize <= 0 {
+			listenerConfig.MaxUploadSize = defaultMaxUploadSize
+		}
+		trustedProxies, err := parseTrustedProxies(listenerConfig.TrustedProxies)
+		if err != nil {
+			checker.add(append(listenerPath, "trusted.proxies"), "%v", err)
+		}
+		moLog := &MoLog{
+			Address:         listenerConfig.Address,
+			TLS:             listenerTLS,
+			ShutdownTimeout: config.ShutdownTimeout,
+			SourceFile:      filename,
+			ConfigFiles:     configFiles,
+			Promtails:       make(map[string]*MoLogPromtail),
+			TestUIs:         make(map[string]*string),
+			MaxUploadSize:   listenerConfig.MaxUploadSize,
+			TrustedProxies:  trustedProxies,
+			S3s:             s3s,
+		}
+		moLogMap[listenerConfig.Address] = moLog
+		addressIndex[listenerConfig.Address] = l
+		if err := moLog.setServicePaths(listenerConfig.EndpointHealth, listenerConfig.EndpointReady, listenerConfig.EndpointMetrics); err != nil {
+			checker.add(listenerPath, "%v", err)
 		}
-		if moLogConfig.PromtailClientConfig["url"] == nil || moLogConfig.PromtailClientConfig["url"] == "" {
-			panic(fmt.Sprintf("Promtail url must be defined for promtail.to.endpoint address [%s]", moLogConfig.Address))
+		if len(listenerConfig.Endpoints) == 0 {
+			checker.add(append(listenerPath, "endpoints"), "at least one endpoint must be defined")
+		}
+
+		for e, endpointConfig := range listenerConfig.Endpoints {
+			endpoint := func(key ...interface{}) []interface{} {
+				return append([]interface{}{"listeners", l, "endpoints", e}, key...)
+			}
+
+			// Redefine default uploadPath to /api/v1
+			if endpointConfig.EndpointUpload == "" {
+				endpointConfig.EndpointUpload = "api/v1"
+			}
+			testPath := endpointConfig.EndpointTest
+			uploadPath := endpointConfig.EndpointUpload
+			if testPath == "" && uploadPath == "" {
+				testPath = "test"
+			}
+			if endpointConfig.EndpointPrefix != "" {
+				testPath = endpointConfig.EndpointPrefix + "/" + testPath
+				uploadPath = endpointConfig.EndpointPrefix + "/" + uploadPath
+			}
+			// paths are given with and without leading slash (/api/v1 or api/v1)
+			testPath = path.Clean("/" + testPath)
+			uploadPath = path.Clean("/" + uploadPath)
+
+			if testPath == uploadPath {
+				checker.add(endpoint("endpoint.test"), "test path and upload path can't be same [%s]", testPath)
+			}
+			testDefinedIn := checker.definedIn(pathEndpoints[moLog.Address+testPath], endpoint())
+			uploadDefinedIn := checker.definedIn(pathEndpoints[moLog.Address+uploadPath], endpoint())
+			if _, exists := moLog.TestUIs[testPath]; exists {
+				checker.add(endpoint("endpoint.test"), "test path [%s] already defined%s", testPath, testDefinedIn)
+			}
+			if _, exists := moLog.Promtails[testPath]; exists {
+				checker.add(endpoint("endpoint.test"), "test path [%s] already defined as upload path%s", testPath, testDefinedIn)
+			}
+			if _, exists := moLog.Promtails[uploadPath]; exists {
+				checker.add(endpoint("endpoint.upload"), "upload path [%s] already defined%s", uploadPath, uploadDefinedIn)
+			}
+			if _, exists := moLog.TestUIs[uploadPath]; exists {
+				checker.add(endpoint("endpoint.upload"), "upload path [%s] already defined as test path%s", uploadPath, uploadDefinedIn)
+			}
+			for _, endpointPath := range []string{testPath, uploadPath} {
+				if _, exists := pathEndpoints[moLog.Address+endpointPath]; !exists {
+					pathEndpoints[moLog.Address+endpointPath] = endpoint()
+				}
+			}
+
+			sink, exists := lokiSinks[endpointConfig.Sink]
+			switch {
+			case endpointConfig.Sink == "" && len(config.Sinks.Loki) == 1:
+				sink = config.Sinks.Loki[0]
+			case endpointConfig.Sink == "":
+				checker.add(endpoint(), "sink must be defined when there are several loki sinks")
+			case !exists && sinkNames[endpointConfig.Sink] != nil:
+				checker.add(endpoint("sink"), "sink [%s] is not a loki sink", endpointConfig.Sink)
+			case !exists:
+				checker.add(endpoint("sink"), "unknown sink [%s]", endpointConfig.Sink)
+			}
+			parser := defaultParser
+			if endpointConfig.Parser != "" {
+				if parser, exists = parsers[endpointConfig.Parser]; !exists {
+					checker.add(endpoint("parser"), "unknown parser [%s]", endpointConfig.Parser)
+					parser = defaultParser
+				}
+			}
+
+			for key, value := range map[string]float64{
+				"rate.limit.requests":       endpointConfig.RateLimitRequests,
+				"rate.limit.requests.burst": float64(endpointConfig.RateLimitRequestsBurst),
+				"rate.limit.bytes":          float64(endpointConfig.RateLimitBytes),
+				"rate.limit.bytes.burst":    float64(endpointConfig.RateLimitBytesBurst),
+				"quota.daily.bytes":         float64(endpointConfig.QuotaDailyBytes),
+				"quota.daily.lines":         float64(endpointConfig.QuotaDailyLines),
+			} {
+				if value < 0 {
+					checker.add(endpoint(key), "must not be negative")
+				}
+			}
+			apiKeys := make([]*APIKey, 0, len(endpointConfig.AuthAPIKeys))
+			for j, keyConfig := range endpointConfig.AuthAPIKeys {
+				apiKey, err := NewAPIKey(keyConfig)
+				if err != nil {
+					checker.add(endpoint("auth.api.keys", j), "%v", err)
+					continue
+				}
+				apiKeys = append(apiKeys, apiKey)
+			}
+			apiKeyHeader := endpointConfig.AuthAPIKeyHeader
+			if apiKeyHeader == "" {
+				apiKeyHeader = defaultAPIKeyHeader
+			}
+			apiKeyQuery := endpointConfig.AuthAPIKeyQuery
+			if apiKeyQuery == "" {
+				apiKeyQuery = defaultAPIKeyQuery
+			}
+			signedURLSecret, err := loadSecret(endpointConfig.AuthSignedURLSecret, endpointConfig.AuthSignedURLSecretFile, endpointConfig.AuthSignedURLSecretEnv)
+			if err != nil {
+				checker.add(endpoint("auth.signed.url.secret.file"), "can't load the secret: %v", err)
+			} else if signedURLSecret == "" && endpointConfig.AuthSignedURLSecretFile != "" {
+				// an empty secret would leave the endpoint without authentication
+				checker.add(endpoint("auth.signed.url.secret.file"), "secret file %s is empty", endpointConfig.AuthSignedURLSecretFile)
+			} else if signedURLSecret == "" && endpointConfig.AuthSignedURLSecretEnv != "" {
+				checker.add(endpoint("auth.signed.url.secret.env"), "environment variable %s is not set or empty", endpointConfig.AuthSignedURLSecretEnv)
+			}
+			var jwtValidator *JWTValidator
+			if endpointConfig.AuthJWT != nil {
+				if jwtValidator, err = NewJWTValidator(*endpointConfig.AuthJWT); err != nil {
+					checker.add(endpoint("auth.jwt"), "%v", err)
+				}
+			}
+			labels, labelErrors := NewEndpointLabels(endpointConfig.Labels, parser.filenamePattern)
+			for name, err := range labelErrors {
+				checker.add(endpoint("labels", name), "%v", err)
+			}
+			queryParams := make([]*QueryParam, 0, len(endpointConfig.QueryParams))
+			queryParamNames := make(map[string]bool)
+			for j, paramConfig := range endpointConfig.QueryParams {
+				if queryParamNames[paramConfig.Name] {
+					checker.add(endpoint("query.params", j, "name"), "query parameter [%s] already defined", paramConfig.Name)
+					continue
+				}
+				queryParamNames[paramConfig.Name] = true
+				param, err := NewQueryParam(paramConfig)
+				if err != nil {
+					checker.add(endpoint("query.params", j), "%v", err)
+					continue
+				}
+				queryParams = append(queryParams, param)
+			}
+			rateLimit, err := NewRateLimit(endpointConfig, nil)
+			if err != nil {
+				checker.add(endpoint("rate.limit.key"), "%v", err)
+			}
+			moLog.TestUIs[testPath] = &uploadPath
+			moLog.Promtails[uploadPath] = &MoLogPromtail{
+				Sink:            sink,
+				FilenamePattern: parser.filenamePattern,
+				ArchiveLimits:   NewArchiveLimits(parser.config),
+				DeviceDedup:     parser.config.DedupDevice,
+				DedupWindow:     parser.config.DedupWindow,
+				ArchiveDedup:    parser.config.DedupArchive,
+				ArchiveEntries:  parser.archiveEntries,
+				Labels:          labels,
+				QueryParams:     queryParams,
+				APIKeys:         apiKeys,
+				APIKeyHeader:    apiKeyHeader,
+				APIKeyQuery:     apiKeyQuery,
+				SignedURLSecret: []byte(signedURLSecret),
+				JWT:             jwtValidator,
+				RateLimit:       rateLimit,
+			}
 		}
-		if _, exists := moLog.TestUIs[testPath]; exists {
-			panic(fmt.Sprintf("test path [%s] already defined", testPath))
+	}
+	for address, moLog := range moLogMap {
+		endpoint := []interface{}{"listeners", addressIndex[address]}
+		if moLog.EndpointHealth == "" {
+			moLog.EndpointHealth = defaultEndpointHealth
 		}
-		if _, exists := moLog.Promtails[testPath]; exists {
-			panic(fmt.Sprintf("test path [%s] already defined as upload path", testPath))
+		if moLog.EndpointReady == "" {
+			moLog.EndpointReady = defaultEndpointReady
 		}
-		if _, exists := moLog.Promtails[uploadPath]; exists {
-			panic(fmt.Sprintf("upload path [%s] already defined", uploadPath))
+		if moLog.EndpointMetrics == "" {
+			moLog.EndpointMetrics = defaultEndpointMetrics
 		}
-		if _, exists := moLog.TestUIs[uploadPath]; exists {
-			panic(fmt.Sprintf("upload path [%s] already defined as test path", uploadPath))
+		if moLog.EndpointHealth == moLog.EndpointReady || moLog.EndpointHealth == moLog.EndpointMetrics || moLog.EndpointReady == moLog.EndpointMetrics {
+			checker.add(endpoint, "health, ready and metrics paths can't be same [%s, %s, %s]", moLog.EndpointHealth, moLog.EndpointReady, moLog.EndpointMetrics)
 		}
-		moLog.TestUIs[testPath] = &uploadPath
-		moLog.Promtails[uploadPath] = &MoLogPromtail{
-			PromtailClientConfig: moLogConfig.PromtailClientConfig,
+		for _, servicePath := range []string{moLog.EndpointHealth, moLog.EndpointReady, moLog.EndpointMetrics} {
+			if _, exists := moLog.TestUIs[servicePath]; exists {
+				checker.add(endpoint, "service path [%s] already defined as test path", servicePath)
+			}
+			if _, exists := moLog.Promtails[servicePath]; exists {
+				checker.add(endpoint, "service path [%s] already defined as upload path", servicePath)
+			}
 		}
 	}
-	moLogSlice := make([]*MoLog, len(moLogMap))
-	i := 0
+	// errors sorted by position in the file, the map order doesn't matter
+	checker.sortErrors()
+	if err := checker.err(); err != nil {
+		return nil, err
+	}
+	moLogSlice := make([]*MoLog, 0, len(moLogMap))
 	for _, moLog := range moLogMap {
-		moLogSlice[i] = moLog
-		i++
+		moLogSlice = append(moLogSlice, moLog)
+	}
+	if !openStores {
+		return moLogSlice, nil
+	}
+
+	// Stores already open by the running config are shared with the reloaded one
+	idempotencyStore, err := openShared("idempotency", storage.Dir, func() (interface{}, error) {
+		return OpenIdempotencyStore(storage.Dir, storage.IdempotencyTTL)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't open idempotency store in %v: %v", storage.Dir, err)
+	}
+	idempotency := idempotencyStore.(*IdempotencyStore)
+	idempotency.SetTTL(storage.IdempotencyTTL)
+	devicesStore, err := openShared("devices", storage.Dir, func() (interface{}, error) {
+		return OpenDeviceDedup(storage.Dir)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't open devices store in %v: %v", storage.Dir, err)
+	}
+	quotasStore, err := openShared("quotas", storage.Dir, func() (interface{}, error) {
+		return OpenQuotaStore(storage.Dir)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't open quota store in %v: %v", storage.Dir, err)
+	}
+	spoolStore, err := openShared("spool", storage.SpoolDir, func() (interface{}, error) {
+		return OpenSpool(storage.SpoolDir, storage.SpoolMaxSize)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't open spool %v: %v", storage.SpoolDir, err)
+	}
+	spool := spoolStore.(*Spool)
+	spool.SetMaxSize(storage.SpoolMaxSize)
+
+	for _, moLog := range moLogSlice {
+		moLog.Idempotency = idempotency
+		moLog.Devices = devicesStore.(*DeviceDedup)
+		moLog.Spool = spool
+		for uploadPath, promtailConfig := range moLog.Promtails {
+			if promtailConfig.RateLimit != nil {
+				promtailConfig.RateLimit.Quotas = quotasStore.(*QuotaStore)
+				promtailConfig.RateLimit.share(moLog.Address + uploadPath)
+			}
+		}
 	}
-	return moLogSlice
+	return moLogSlice, nil
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Schema versions of the config file, files without schema.version are 1.0
+const (
+	schemaVersion1 = "1.0"
+	schemaVersion2 = "2.0"
+)
+
+// ConfigV1 YAML config file of schema 1.0, loaded by migration to 2.0
+type ConfigV1 struct {
+	SchemaVersion   string            `yaml:"schema.version"`
+	TLSCertFile     string            `yaml:"tls.cert.file"`
+	TLSKeyFile      string            `yaml:"tls.key.file"`
+	TLSClientCAFile string            `yaml:"tls.client.ca.file"`
+	TLSClientAuth   string            `yaml:"tls.client.auth"`
+	TLSClientLabels map[string]string `yaml:"tls.client.labels"`
+	StorageDir      string            `yaml:"storage.dir"`
+	IdempotencyTTL  time.Duration     `yaml:"idempotency.ttl"`
+	SpoolDir        string            `yaml:"spool.dir"`
+	SpoolMaxSize    int64             `yaml:"spool.max.size"`
+	ShutdownTimeout time.Duration     `yaml:"shutdown.timeout"`
+	ConfigMoLogs    []ConfigMoLog     `yaml:"promtail.to.endpoint"`
+	ConfigS3s       []ConfigS3        `yaml:"s3.bucket.endpoint"`
+	Include         []string          `yaml:"include"`
+
+	// keys of no field, 1.0 didn't report them
+	Unknown map[string]interface{} `yaml:",inline"`
+}
+
+// ConfigMoLog upload endpoint of schema 1.0, listener, parser and promtail client settings in one entry
+type ConfigMoLog struct {
+	PromtailClientConfig    map[string]interface{} `yaml:"promtail.client.config"`
+	Address                 string                 `yaml:"address"`
+	MaxUploadSize           int64                  `yaml:"max.upload.size"`
+	EndpointPrefix          string                 `yaml:"endpoint.prefix"`
+	EndpointTest            string                 `yaml:"endpoint.test"`
+	EndpointUpload          string                 `yaml:"endpoint.upload"`
+	EndpointHealth          string                 `yaml:"endpoint.health"`
+	EndpointReady           string                 `yaml:"endpoint.ready"`
+	EndpointMetrics         string                 `yaml:"endpoint.metrics"`
+	Compression             bool                   `yaml:"compression"`
+	FilenamePattern         string                 `yaml:"filename.pattern"`
+	DedupDevice             bool                   `yaml:"dedup.device"`
+	DedupWindow             int                    `yaml:"dedup.window"`
+	DedupArchive            bool                   `yaml:"dedup.archive"`
+	ArchiveEntries          []string               `yaml:"archive.entries"`
+	AuthAPIKeys             []ConfigAPIKey         `yaml:"auth.api.keys"`
+	AuthAPIKeyHeader        string                 `yaml:"auth.api.key.header"`
+	AuthAPIKeyQuery         string                 `yaml:"auth.api.key.query"`
+	AuthSignedURLSecret     string                 `yaml:"auth.signed.url.secret"`
+	AuthSignedURLSecretFile string                 `yaml:"auth.signed.url.secret.file"`
+	AuthSignedURLSecretEnv  string                 `yaml:"auth.signed.url.secret.env"`
+	AuthJWT                 *ConfigJWT             `yaml:"auth.jwt"`
+
+	RateLimitKey           string  `yaml:"rate.limit.key"`
+	RateLimitRequests      float64 `yaml:"rate.limit.requests"`
+	RateLimitRequestsBurst int     `yaml:"rate.limit.requests.burst"`
+	RateLimitBytes         int64   `yaml:"rate.limit.bytes"`
+	RateLimitBytesBurst    int64   `yaml:"rate.limit.bytes.burst"`
+	QuotaDailyBytes        int64   `yaml:"quota.daily.bytes"`
+	QuotaDailyLines        int64   `yaml:"quota.daily.lines"`
+
+	ArchiveMaxUncompressedSize int64   `yaml:"archive.max.uncompressed.size"`
+	ArchiveMaxEntrySize        int64   `yaml:"archive.max.entry.size"`
+	ArchiveMaxCompressionRatio float64 `yaml:"archive.max.compression.ratio"`
+	ArchiveMaxEntries          int     `yaml:"archive.max.entries"`
+	ArchiveMaxDepth            int     `yaml:"archive.max.depth"`
+	ArchiveMaxPathLength       int     `yaml:"archive.max.path.length"`
+
+	Unknown map[string]interface{} `yaml:",inline"`
+}
+
+// ConfigS3 S3 object storage of schema 1.0
+type ConfigS3 struct {
+	S3ClientConfig map[string]interface{} `yaml:"s3.client.config"`
+
+	// keys of the client config indented as siblings of s3.client.config end up here
+	Unknown map[string]interface{} `yaml:",inline"`
+}
+
+// Keys of the untyped 1.0 client configs kept by the migration
+var (
+	promtailClientConfigKeys = map[string]bool{"url": true, "ready.url": true}
+	s3ClientConfigKeys       = map[string]bool{
+		"endpoint": true, "bucket": true, "region": true, "access.key.id": true, "secret.access.key": true, "use.ssl": true,
+	}
+)
+
+// configString value of the untyped client config as string, empty for missing key
+func configString(clientConfig map[string]interface{}, key string) string {
+	if value, exists := clientConfig[key]; exists && value != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
+
+// unknownKeys keys of the untyped client config the 2.0 schema has no field for, sorted
+func unknownKeys(clientConfig map[string]interface{}, known map[string]bool) []string {
+	var unknown []string
+	for key := range clientConfig {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// unknownSiblings warnings for the keys of the section the 1.0 schema has no field for,
+// keys of the client config are likely indented wrongly
+func unknownSiblings(checker *configChecker, source []interface{}, section map[string]interface{}, clientConfig string, clientConfigKeys map[string]bool) {
+	for _, key := range unknownKeys(section, nil) {
+		warning := fmt.Sprintf("%s is unknown and is dropped", formatFieldPath(append(source[:len(source):len(source)], key)))
+		if clientConfigKeys[key] {
+			warning += fmt.Sprintf(", indent it under %s to keep it", clientConfig)
+		}
+		checker.warnings = append(checker.warnings, warning)
+	}
+}
+
+// migrateConfig converts the 1.0 config to 2.0. Endpoints of the same address become one listener,
+// equal promtail client configs and parser settings are shared. Errors are reported with the 1.0 paths,
+// the paths of the 2.0 config are mapped back to the 1.0 fields by checker.sources.
+// Warnings name settings 2.0 doesn't have, they are dropped.
+func migrateConfig(v1 ConfigV1, checker *configChecker) *Config {
+	config := &Config{
+		SchemaVersion: schemaVersion2,
+		Storage: ConfigStorage{
+			Dir:            v1.StorageDir,
+			IdempotencyTTL: v1.IdempotencyTTL,
+			SpoolDir:       v1.SpoolDir,
+			SpoolMaxSize:   v1.SpoolMaxSize,
+		},
+		ShutdownTimeout: v1.ShutdownTimeout,
+		Include:         v1.Include,
+	}
+	// TLS of 1.0 is global, every listener gets it
+	listenerTLS := ConfigTLS{
+		CertFile:     v1.TLSCertFile,
+		KeyFile:      v1.TLSKeyFile,
+		ClientCAFile: v1.TLSClientCAFile,
+		ClientAuth:   v1.TLSClientAuth,
+		ClientLabels: v1.TLSClientLabels,
+	}
+	checker.sources = map[string]fieldSource{
+		"storage.dir":             {path: []interface{}{"storage.dir"}},
+		"storage.idempotency.ttl": {path: []interface{}{"idempotency.ttl"}},
+		"storage.spool.dir":       {path: []interface{}{"spool.dir"}},
+		"storage.spool.max.size":  {path: []interface{}{"spool.max.size"}},
+		"listeners":               {path: []interface{}{"promtail.to.endpoint"}},
+		"sinks.loki":              {path: []interface{}{"promtail.to.endpoint"}},
+		"sinks.s3":                {path: []interface{}{"s3.bucket.endpoint"}},
+	}
+	unknownSiblings(checker, nil, v1.Unknown, "", nil)
+	for i, s3Config := range v1.ConfigS3s {
+		unknownSiblings(checker, []interface{}{"s3.bucket.endpoint", i}, s3Config.Unknown, "s3.client.config", s3ClientConfigKeys)
+		source := []interface{}{"s3.bucket.endpoint", i, "s3.client.config"}
+		for _, key := range unknownKeys(s3Config.S3ClientConfig, s3ClientConfigKeys) {
+			checker.warnings = append(checker.warnings, fmt.Sprintf("%s.%s is not supported and is dropped", formatFieldPath(source), key))
+		}
+		if configString(s3Config.S3ClientConfig, "endpoint") == "" {
+			// a sink can't be built without endpoint, its keys are likely indented wrongly
+			checker.warnings = append(checker.warnings, fmt.Sprintf("%s has no endpoint, the S3 sink is dropped", formatFieldPath(source)))
+			continue
+		}
+		checker.sources[fmt.Sprintf("sinks.s3[%d]", len(config.Sinks.S3))] = fieldSource{path: source}
+		config.Sinks.S3 = append(config.Sinks.S3, ConfigS3Sink{
+			Name:            fmt.Sprintf("s3-%d", i+1),
+			Endpoint:        configString(s3Config.S3ClientConfig, "endpoint"),
+			Bucket:          configString(s3Config.S3ClientConfig, "bucket"),
+			Region:          configString(s3Config.S3ClientConfig, "region"),
+			AccessKeyID:     configString(s3Config.S3ClientConfig, "access.key.id"),
+			SecretAccessKey: configString(s3Config.S3ClientConfig, "secret.access.key"),
+			UseSSL:          configString(s3Config.S3ClientConfig, "use.ssl") == "true",
+		})
+	}
+
+	listenerIndex := make(map[string]int)
+	for i, moLogConfig := range v1.ConfigMoLogs {
+		source := []interface{}{"promtail.to.endpoint", i}
+		unknownSiblings(checker, source, moLogConfig.Unknown, "promtail.client.config", promtailClientConfigKeys)
+		address := moLogConfig.Address
+		if address == "" {
+			address = defaultAddress
+		}
+		l, exists := listenerIndex[address]
+		if !exists {
+			l = len(config.Listeners)
+			listenerIndex[address] = l
+			config.Listeners = append(config.Listeners, ConfigListener{Address: address, MaxUploadSize: moLogConfig.MaxUploadSize})
+			checker.sources[fmt.Sprintf("listeners[%d]", l)] = fieldSource{path: source}
+			if !reflect.DeepEqual(listenerTLS, ConfigTLS{}) {
+				tlsConfig := listenerTLS
+				config.Listeners[l].TLS = &tlsConfig
+				for _, key := range []string{"cert.file", "key.file", "client.ca.file", "client.auth", "client.labels"} {
+					checker.sources[fmt.Sprintf("listeners[%d].tls.%s", l, key)] = fieldSource{path: []interface{}{"tls." + key}}
+				}
+				// errors of the whole section are reported at the certificate
+				checker.sources[fmt.Sprintf("listeners[%d].tls", l)] = fieldSource{path: []interface{}{"tls.cert.file"}}
+			}
+		}
+		listenerConfig := &config.Listeners[l]
+		if moLogConfig.MaxUploadSize != 0 && moLogConfig.MaxUploadSize != listenerConfig.MaxUploadSize {
+			// the first endpoint of the address always gave the limit of all its endpoints
+			checker.warnings = append(checker.warnings, fmt.Sprintf("%s.max.upload.size is dropped, the limit of address [%s] is %d", formatFieldPath(source), address, listenerConfig.MaxUploadSize))
+		}
+		for _, servicePath := range []struct {
+			key        string
+			configured string
+			target     *string
+		}{
+			{"endpoint.health", moLogConfig.EndpointHealth, &listenerConfig.EndpointHealth},
+			{"endpoint.ready", moLogConfig.EndpointReady, &listenerConfig.EndpointReady},
+			{"endpoint.metrics", moLogConfig.EndpointMetrics, &listenerConfig.EndpointMetrics},
+		} {
+			if servicePath.configured == "" {
+				continue
+			}
+			if *servicePath.target != "" && *servicePath.target != servicePath.configured {
+				checker.add(append(source, servicePath.key), "%s [%s] conflicts with [%s] for address [%s]", servicePath.key, servicePath.configured, *servicePath.target, address)
+				continue
+			}
+			*servicePath.target = servicePath.configured
+		}
+
+		clientSource := append(source[:len(source):len(source)], "promtail.client.config")
+		for _, key := range unknownKeys(moLogConfig.PromtailClientConfig, promtailClientConfigKeys) {
+			checker.warnings = append(checker.warnings, fmt.Sprintf("%s.%s is not supported and is dropped", formatFieldPath(clientSource), key))
+		}
+		if moLogConfig.Compression {
+			checker.warnings = append(checker.warnings, fmt.Sprintf("%s.compression is not supported and is dropped", formatFieldPath(source)))
+		}
+		sink := ConfigLokiSink{
+			URL:      configString(moLogConfig.PromtailClientConfig, "url"),
+			ReadyURL: configString(moLogConfig.PromtailClientConfig, "ready.url"),
+		}
+		for _, existing := range config.Sinks.Loki {
+			if existing.URL == sink.URL && existing.ReadyURL == sink.ReadyURL {
+				sink.Name = existing.Name
+			}
+		}
+		if sink.Name == "" {
+			sink.Name = "loki"
+			if len(config.Sinks.Loki) > 0 {
+				sink.Name = fmt.Sprintf("loki-%d", len(config.Sinks.Loki)+1)
+			}
+			checker.sources[fmt.Sprintf("sinks.loki[%d]", len(config.Sinks.Loki))] = fieldSource{path: clientSource}
+			config.Sinks.Loki = append(config.Sinks.Loki, sink)
+		}
+
+		parser := ConfigParser{
+			FilenamePattern:            moLogConfig.FilenamePattern,
+			ArchiveEntries:             moLogConfig.ArchiveEntries,
+			DedupDevice:                moLogConfig.DedupDevice,
+			DedupWindow:                moLogConfig.DedupWindow,
+			DedupArchive:               moLogConfig.DedupArchive,
+			ArchiveMaxUncompressedSize: moLogConfig.ArchiveMaxUncompressedSize,
+			ArchiveMaxEntrySize:        moLogConfig.ArchiveMaxEntrySize,
+			ArchiveMaxCompressionRatio: moLogConfig.ArchiveMaxCompressionRatio,
+			ArchiveMaxEntries:          moLogConfig.ArchiveMaxEntries,
+			ArchiveMaxDepth:            moLogConfig.ArchiveMaxDepth,
+			ArchiveMaxPathLength:       moLogConfig.ArchiveMaxPathLength,
+		}
+		if !reflect.DeepEqual(parser, ConfigParser{}) {
+			for _, existing := range config.Parsers {
+				parser.Name = existing.Name
+				if reflect.DeepEqual(parser, existing) {
+					break
+				}
+				parser.Name = ""
+			}
+			if parser.Name == "" {
+				parser.Name = fmt.Sprintf("parser-%d", len(config.Parsers)+1)
+				checker.sources[fmt.Sprintf("parsers[%d]", len(config.Parsers))] = fieldSource{path: source}
+				config.Parsers = append(config.Parsers, parser)
+			}
+		}
+
+		checker.sources[fmt.Sprintf("listeners[%d].endpoints[%d]", l, len(listenerConfig.Endpoints))] = fieldSource{path: source}
+		listenerConfig.Endpoints = append(listenerConfig.Endpoints, ConfigEndpoint{
+			EndpointPrefix:          moLogConfig.EndpointPrefix,
+			EndpointTest:            moLogConfig.EndpointTest,
+			EndpointUpload:          moLogConfig.EndpointUpload,
+			Sink:                    sink.Name,
+			Parser:                  parser.Name,
+			AuthAPIKeys:             moLogConfig.AuthAPIKeys,
+			AuthAPIKeyHeader:        moLogConfig.AuthAPIKeyHeader,
+			AuthAPIKeyQuery:         moLogConfig.AuthAPIKeyQuery,
+			AuthSignedURLSecret:     moLogConfig.AuthSignedURLSecret,
+			AuthSignedURLSecretFile: moLogConfig.AuthSignedURLSecretFile,
+			AuthSignedURLSecretEnv:  moLogConfig.AuthSignedURLSecretEnv,
+			AuthJWT:                 moLogConfig.AuthJWT,
+			RateLimitKey:            moLogConfig.RateLimitKey,
+			RateLimitRequests:       moLogConfig.RateLimitRequests,
+			RateLimitRequestsBurst:  moLogConfig.RateLimitRequestsBurst,
+			RateLimitBytes:          moLogConfig.RateLimitBytes,
+			RateLimitBytesBurst:     moLogConfig.RateLimitBytesBurst,
+			QuotaDailyBytes:         moLogConfig.QuotaDailyBytes,
+			QuotaDailyLines:         moLogConfig.QuotaDailyLines,
+		})
+	}
+	return config
+}
+
+// MigrateConfig the 1.0 config file upgraded to schema 2.0, references ${ENV} and file: are kept as they are.
+// Warnings name settings that are dropped.
+func MigrateConfig(filename string) ([]byte, []string, error) {
+	fileContent, err := os.ReadFile(filename)
+	if err != nil {
+		absPath, _ := filepath.Abs(filename)
+		return nil, nil, &ConfigError{File: absPath, Message: err.Error()}
+	}
+	checker := newConfigChecker(filename, fileContent)
+	config, version := decodeConfig(fileContent, checker, schemaVersion1)
+	if err := checker.err(); err != nil {
+		return nil, nil, err
+	}
+	if version != schemaVersion1 {
+		return nil, nil, fmt.Errorf("%s has schema %s already", filename, config.SchemaVersion)
+	}
+	// dropped settings may leave required ones empty, errors are reported at the 1.0 fields
+	fileWarnings, err := checkConfigContent(filename, fileContent)
+	if err != nil {
+		return nil, checker.warnings, err
+	}
+	var migrated bytes.Buffer
+	fmt.Fprintf(&migrated, "# migrated from schema %s by molog migrate-config, comments of the original file are not kept\n", schemaVersion1)
+	encoder := yamlv3.NewEncoder(&migrated)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return nil, nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, nil, err
+	}
+	// the written file must load the same
+	if _, err := checkConfigContent(filename, migrated.Bytes()); err != nil {
+		return nil, checker.warnings, fmt.Errorf("migrated config is invalid:\n%v", err)
+	}
+	return migrated.Bytes(), fileWarnings, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baselineConfig config.yaml shipped with 1.0, the keys of s3.client.config are indented as its siblings
+const baselineConfig = `schema.version: "1.0"
+# tls.cert.file: ./certs/mydomain.crt
+# tls.key.file: ./certs/mydomain.key
+promtail.to.endpoint:
+  # first Promtail config entry
+  - promtail.client.config:
+      url: http://promtail:3500/loki/api/v1/push # required
+
+s3.bucket.endpoint:
+  - s3.client.config:
+    endpoint: minio:9000
+    access.key.id: Q3AM3UQ867SPQQA43P2F
+    secret.access.key: zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG
+    use.ssl: false
+`
+
+func TestMigrateBaselineConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(baselineConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckConfig(filename); err != nil {
+		t.Fatalf("1.0 config doesn't load: %v", err)
+	}
+
+	migrated, warnings, err := MigrateConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"s3.bucket.endpoint[0].endpoint is unknown and is dropped, indent it under s3.client.config to keep it",
+		"s3.bucket.endpoint[0].s3.client.config has no endpoint, the S3 sink is dropped",
+	} {
+		if !strings.Contains(strings.Join(warnings, "\n"), want) {
+			t.Errorf("warnings %q miss %q", warnings, want)
+		}
+	}
+
+	migratedFilename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(migratedFilename, migrated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	moLogs, err := loadMoLog(migratedFilename, false)
+	if err != nil {
+		t.Fatalf("migrated config doesn't load: %v\n%s", err, migrated)
+	}
+	if len(moLogs) != 1 || len(moLogs[0].S3s) != 0 {
+		t.Fatalf("migrated config has %d listeners, want 1 without S3 sinks:\n%s", len(moLogs), migrated)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultDedupWindow = 10000
+
+// Device state is forgotten when the device doesn't upload anything during this time
+const deviceStateTTL = 30 * 24 * time.Hour
+
+// DeviceDedup remembers per device (label set) which lines were already pushed,
+// so overlapping rolling log files are ingested once
+type DeviceDedup struct {
+	store *FileStore
+	mu    sync.Mutex
+	locks map[string]*deviceLock
+}
+
+// deviceLock lock of the device, freed when no upload of the device holds or waits for it
+type deviceLock struct {
+	sync.Mutex
+	users int
+}
+
+// DeviceState high-water mark of ingested timestamps and hashes of the last ingested lines
+type DeviceState struct {
+	HighWaterMark time.Time `json:"high.water.mark"`
+	Hashes        []uint64  `json:"hashes"`
+
+	key     string
+	window  int
+	seen    map[uint64]bool
+	lastHWM time.Time
+}
+
+// OpenDeviceDedup opens devices state store in the storage directory
+func OpenDeviceDedup(storageDir string) (*DeviceDedup, error) {
+	store, err := OpenFileStore(filepath.Join(storageDir, "devices"))
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceDedup{
+		store: store,
+		locks: make(map[string]*deviceLock),
+	}, nil
+}
+
+// deviceKey identifies the device by the upload path and its sorted label set
+func deviceKey(uploadPath string, labels map[string]*string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := sha256.New()
+	key.Write([]byte(uploadPath))
+	for _, name := range names {
+		key.Write([]byte{0})
+		key.Write([]byte(name))
+		key.Write([]byte{'='})
+		key.Write([]byte(*labels[name]))
+	}
+	return hex.EncodeToString(key.Sum(nil))
+}
+
+// lineHash hash of the line together with its timestamp
+func lineHash(timestamp time.Time, line string) uint64 {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.LittleEndian, timestamp.UnixNano())
+	hash.Write([]byte(line))
+	return hash.Sum64()
+}
+
+// Acquire loads the device state and locks it against concurrent uploads of the same device until Release
+func (dedup *DeviceDedup) Acquire(key string, window int) (*DeviceState, error) {
+	dedup.mu.Lock()
+	lock, exists := dedup.locks[key]
+	if !exists {
+		lock = new(deviceLock)
+		dedup.locks[key] = lock
+	}
+	lock.users++
+	dedup.mu.Unlock()
+	lock.Lock()
+
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+	state := &DeviceState{}
+	if _, err := dedup.store.Get(key, state); err != nil {
+		dedup.unlock(key)
+		return nil, err
+	}
+	state.key = key
+	state.window = window
+	state.lastHWM = state.HighWaterMark
+	state.seen = make(map[uint64]bool, len(state.Hashes))
+	for _, hash := range state.Hashes {
+		state.seen[hash] = true
+	}
+	return state, nil
+}
+
+// Release saves lines pushed during the upload and unlocks the device
+func (dedup *DeviceDedup) Release(state *DeviceState) error {
+	defer dedup.unlock(state.key)
+	if len(state.Hashes) > state.window {
+		state.Hashes = state.Hashes[len(state.Hashes)-state.window:]
+	}
+	return dedup.store.Put(state.key, state, deviceStateTTL)
+}
+
+// unlock unlocks the device, its lock is freed when no other upload waits for it
+func (dedup *DeviceDedup) unlock(key string) {
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+	lock := dedup.locks[key]
+	lock.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(dedup.locks, key)
+	}
+}
+
+// Pushed reports whether the line was pushed by one of the earlier uploads:
+// it is older than the high-water mark or its hash is in the rolling window
+func (state *DeviceState) Pushed(timestamp time.Time, hash uint64) bool {
+	return timestamp.Before(state.lastHWM) || state.seen[hash]
+}
+
+// Add records the pushed line
+func (state *DeviceState) Add(timestamp time.Time, hash uint64) {
+	if timestamp.After(state.HighWaterMark) {
+		state.HighWaterMark = timestamp
+	}
+	state.Hashes = append(state.Hashes, hash)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// defaultFilenamePattern matches archive names produced by the mobile clients, e.g. 12.23.23_00.09.58_809.zip
+const defaultFilenamePattern = `^(?P<month>\d{2})\.(?P<day>\d{2})\.(?P<year>\d{2})(?:_(?P<hour>\d{2})\.(?P<minute>\d{2})\.(?P<second>\d{2})(?:_(?P<millisecond>\d{3}))?)?`
+
+// defaultLocation time zone of the device clocks
+var defaultLocation = time.FixedZone("", 3*60*60)
+
+// Named groups of filename.pattern which are used for the base date/time, other groups become labels
+var filenameTimeGroups = map[string]bool{
+	"year":        true,
+	"month":       true,
+	"day":         true,
+	"hour":        true,
+	"minute":      true,
+	"second":      true,
+	"millisecond": true,
+}
+
+// FilenameInfo base date/time and extra labels taken from the uploaded file name
+type FilenameInfo struct {
+	Time    time.Time
+	Matched bool // false when the name doesn't match the pattern and Time is the upload time
+	HasTime bool // the pattern provided the time of day, not only the date
+	Labels  map[string]string
+}
+
+// parseFilename extracts base date/time and labels from the filename,
+// falls back to the upload time when the name doesn't match the pattern or holds an invalid date
+func parseFilename(pattern *regexp.Regexp, filename string, uploadTime time.Time) FilenameInfo {
+	fallback := FilenameInfo{
+		Time:   uploadTime.In(defaultLocation),
+		Labels: make(map[string]string),
+	}
+	if pattern == nil || filename == "" {
+		return fallback
+	}
+	subMatch := pattern.FindStringSubmatch(filename)
+	if subMatch == nil {
+		return fallback
+	}
+
+	values := make(map[string]int)
+	labels := make(map[string]string)
+	for i, name := range pattern.SubexpNames() {
+		if name == "" || subMatch[i] == "" {
+			continue
+		}
+		if !filenameTimeGroups[name] {
+			labels[name] = subMatch[i]
+			continue
+		}
+		value, err := strconv.Atoi(subMatch[i])
+		if err != nil {
+			return fallback
+		}
+		values[name] = value
+	}
+
+	year, hasYear := values["year"]
+	month, hasMonth := values["month"]
+	day, hasDay := values["day"]
+	if !hasYear || !hasMonth || !hasDay {
+		fallback.Labels = labels
+		return fallback
+	}
+	if year < 100 {
+		year += 2000
+	}
+	_, hasTime := values["hour"]
+	timestamp := time.Date(
+		year,
+		time.Month(month),
+		day,
+		values["hour"],
+		values["minute"],
+		values["second"],
+		values["millisecond"]*int(time.Millisecond),
+		defaultLocation,
+	)
+	// time.Date normalizes out of range values (e.g. month 13), such names are not dates
+	if timestamp.Year() != year || int(timestamp.Month()) != month || timestamp.Day() != day ||
+		timestamp.Hour() != values["hour"] || timestamp.Minute() != values["minute"] || timestamp.Second() != values["second"] {
+		fallback.Labels = labels
+		return fallback
+	}
+	return FilenameInfo{
+		Time:    timestamp,
+		Matched: true,
+		HasTime: hasTime,
+		Labels:  labels,
+	}
+}
+
+// Lines earlier than the base time by more than this belong to the next day
+const midnightRolloverThreshold = 12 * time.Hour
+
+// lineTimestamp combines the base date with time of day of a log line,
+// a line far earlier than the base time of day belongs to the next day (log crossed midnight)
+func (info FilenameInfo) lineTimestamp(hour, minute, second, nanosecond int) time.Time {
+	base := info.Time
+	timestamp := time.Date(base.Year(), base.Month(), base.Day(), hour, minute, second, nanosecond, base.Location())
+	if info.HasTime && base.Sub(timestamp) > midnightRolloverThreshold {
+		timestamp = timestamp.AddDate(0, 0, 1)
+	}
+	return timestamp
+}
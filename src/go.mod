@@ -1,10 +1,11 @@
-module main
+module molog
 
 go 1.21
 
 require (
 	github.com/minio/minio-go/v7 v7.0.66
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default paths of liveness and readiness endpoints
+const (
+	defaultEndpointHealth = "/healthz"
+	defaultEndpointReady  = "/readyz"
+)
+
+// Time limit of every dependency probe
+const healthProbeTimeout = 3 * time.Second
+
+// HealthCheck state of one dependency
+type HealthCheck struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// HealthResult JSON body of liveness and readiness responses
+type HealthResult struct {
+	OK     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// setServicePaths sets liveness, readiness and metrics paths of the listener, all endpoints of the same address must agree
+func (moLog *MoLog) setServicePaths(healthPath string, readyPath string, metricsPath string) error {
+	for _, servicePath := range []struct {
+		key        string
+		configured string
+		target     *string
+	}{
+		{"endpoint.health", healthPath, &moLog.EndpointHealth},
+		{"endpoint.ready", readyPath, &moLog.EndpointReady},
+		{"endpoint.metrics", metricsPath, &moLog.EndpointMetrics},
+	} {
+		if servicePath.configured == "" {
+			continue
+		}
+		configured := "/" + strings.Trim(servicePath.configured, "/")
+		if *servicePath.target != "" && *servicePath.target != configured {
+			return fmt.Errorf("%s [%s] conflicts with [%s] for address [%s]", servicePath.key, configured, *servicePath.target, moLog.Address)
+		}
+		*servicePath.target = configured
+	}
+	return nil
+}
+
+// promtailReadyURL readiness URL of promtail (loki), ready.url of the sink or /ready next to the push url
+func promtailReadyURL(sink ConfigLokiSink) (string, error) {
+	if sink.ReadyURL != "" {
+		return sink.ReadyURL, nil
+	}
+	pushURL, err := url.Parse(sink.URL)
+	if err != nil {
+		return "", err
+	}
+	pushURL.Path = strings.TrimSuffix(strings.TrimSuffix(pushURL.Path, "/loki/api/v1/push"), "/api/prom/push") + "/ready"
+	pushURL.RawQuery = ""
+	return pushURL.String(), nil
+}
+
+func probeURL(ctx context.Context, probeURL string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", probeURL, response.StatusCode)
+	}
+	return nil
+}
+
+// serveHealth process is alive
+func (moLog *MoLog) serveHealth(responseWriter http.ResponseWriter, request *http.Request) {
+	writeJSON(responseWriter, http.StatusOK, HealthResult{OK: true})
+}
+
+// serveReady probes promtail endpoints of the listener, S3 buckets and the spool
+func (moLog *MoLog) serveReady(responseWriter http.ResponseWriter, request *http.Request) {
+	probes := make(map[string]func(ctx context.Context) error)
+	for _, promtailConfig := range moLog.Promtails {
+		readyURL, err := promtailReadyURL(promtailConfig.Sink)
+		if err != nil {
+			probes["promtail:"+promtailConfig.Sink.URL] = func(ctx context.Context) error { return err }
+			continue
+		}
+		probes["promtail:"+readyURL] = func(ctx context.Context) error { return probeURL(ctx, readyURL) }
+	}
+	for _, s3 := range moLog.S3s {
+		probes[s3.Name()] = s3.Probe
+	}
+	if moLog.Spool != nil {
+		probes["spool"] = func(ctx context.Context) error {
+			if moLog.Spool.Full() {
+				return errSpoolFull
+			}
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), healthProbeTimeout)
+	defer cancel()
+	result := HealthResult{OK: true}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, probe := range probes {
+		wg.Add(1)
+		go func(name string, probe func(ctx context.Context) error) {
+			defer wg.Done()
+			started := time.Now()
+			err := probe(ctx)
+			check := HealthCheck{Name: name, OK: err == nil, DurationMs: time.Since(started).Milliseconds()}
+			if err != nil {
+				check.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			result.Checks = append(result.Checks, check)
+			result.OK = result.OK && check.OK
+		}(name, probe)
+	}
+	wg.Wait()
+	sort.Slice(result.Checks, func(i, j int) bool { return result.Checks[i].Name < result.Checks[j].Name })
+
+	status := http.StatusOK
+	if !result.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(responseWriter, status, result)
+}
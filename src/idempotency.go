@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotencyKeyHeader lets a client name the upload, retries with the same key are not ingested again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var errUploadInProgress = errors.New("upload with the same content is in progress")
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was used for another content")
+
+// IdempotencyStore remembers processed uploads so retried uploads are answered with the original result
+type IdempotencyStore struct {
+	store   *FileStore
+	ttl     time.Duration
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+type idempotencyRecord struct {
+	ContentHash string       `json:"content.hash"`
+	Result      UploadResult `json:"result"`
+}
+
+// OpenIdempotencyStore opens processed uploads store in the storage directory
+func OpenIdempotencyStore(storageDir string, ttl time.Duration) (*IdempotencyStore, error) {
+	store, err := OpenFileStore(filepath.Join(storageDir, "idempotency"))
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return &IdempotencyStore{
+		store:   store,
+		ttl:     ttl,
+		pending: make(map[string]bool),
+	}, nil
+}
+
+// uploadIdempotencyKey makes the key of the upload and the hash of its content.
+// Without Idempotency-Key header the key is the hash of upload path, query and content.
+func uploadIdempotencyKey(request *http.Request, uploadedFile multipart.File) (string, string, error) {
+	contentHash := sha256.New()
+	if _, err := io.Copy(contentHash, uploadedFile); err != nil {
+		return "", "", err
+	}
+	if _, err := uploadedFile.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	content := hex.EncodeToString(contentHash.Sum(nil))
+
+	key := sha256.New()
+	io.WriteString(key, request.URL.Path)
+	key.Write([]byte{0})
+	if clientKey := request.Header.Get(IdempotencyKeyHeader); clientKey != "" {
+		io.WriteString(key, "key:")
+		io.WriteString(key, clientKey)
+	} else {
+		io.WriteString(key, request.URL.Query().Encode())
+		key.Write([]byte{0})
+		io.WriteString(key, content)
+	}
+	return hex.EncodeToString(key.Sum(nil)), content, nil
+}
+
+// Begin returns the result of already processed upload with the same key,
+// otherwise marks the key as in progress until Finish is called
+func (idempotency *IdempotencyStore) Begin(key string, contentHash string) (*UploadResult, error) {
+	idempotency.mu.Lock()
+	defer idempotency.mu.Unlock()
+	if idempotency.pending[key] {
+		return nil, errUploadInProgress
+	}
+	var record idempotencyRecord
+	found, err := idempotency.store.Get(key, &record)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if record.ContentHash != contentHash {
+			return nil, errIdempotencyKeyReused
+		}
+		return &record.Result, nil
+	}
+	idempotency.pending[key] = true
+	return nil, nil
+}
+
+// Finish releases the key, the result of successfully processed upload is remembered for the TTL
+func (idempotency *IdempotencyStore) Finish(key string, contentHash string, result *UploadResult) error {
+	idempotency.mu.Lock()
+	defer idempotency.mu.Unlock()
+	delete(idempotency.pending, key)
+	if result == nil {
+		return nil
+	}
+	return idempotency.store.Put(key, idempotencyRecord{contentHash, *result}, idempotency.ttl)
+}
+
+// SetTTL changes the TTL of results remembered from now on
+func (idempotency *IdempotencyStore) SetTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	idempotency.mu.Lock()
+	defer idempotency.mu.Unlock()
+	idempotency.ttl = ttl
+}
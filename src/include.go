@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Fragments of an included directory
+var includeDirPatterns = []string{"*.yaml", "*.yml"}
+
+// include merges the fragments of the include entries into the config and returns the files and
+// directories of the config to watch. Entries are files, glob patterns or directories (conf.d),
+// relative to the directory of the config file. Fragments add sinks, parsers and listeners,
+// endpoints of a listener address defined by several files are merged into one listener.
+func (checker *configChecker) include(config *Config, filename string, version string) []string {
+	configFiles := []string{filename}
+	if len(config.Include) > 0 {
+		defaultSink(config)
+	}
+	included := map[string]bool{filepath.Clean(filename): true}
+	for i, entry := range config.Include {
+		includePath := []interface{}{"include", i}
+		pattern := entry
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		var fragmentFiles []string
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			configFiles = append(configFiles, pattern)
+			for _, dirPattern := range includeDirPatterns {
+				matches, _ := filepath.Glob(filepath.Join(pattern, dirPattern))
+				fragmentFiles = append(fragmentFiles, matches...)
+			}
+		} else if strings.ContainsAny(pattern, "*?[") {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				checker.add(includePath, "invalid pattern %q: %v", entry, err)
+				continue
+			}
+			// files added to the directory are picked up by the watch
+			configFiles = append(configFiles, filepath.Dir(pattern))
+			fragmentFiles = matches
+		} else if err != nil {
+			checker.add(includePath, "can't include %s: %v", entry, err)
+			continue
+		} else {
+			fragmentFiles = []string{pattern}
+		}
+		for _, fragmentFile := range fragmentFiles {
+			if included[filepath.Clean(fragmentFile)] {
+				continue
+			}
+			included[filepath.Clean(fragmentFile)] = true
+			configFiles = append(configFiles, fragmentFile)
+			checker.includeFragment(config, fragmentFile, version)
+		}
+	}
+	return configFiles
+}
+
+// includeFragment merges the fragment file into the config, fragments without schema.version have the version of the config.
+// Sinks and parsers of the same name and settings are defined once, names given by the migration of 1.0 fragments are
+// renamed when another file uses them. Errors of merged fields are reported in the fragment.
+func (checker *configChecker) includeFragment(config *Config, fragmentFile string, version string) {
+	fileContent, err := os.ReadFile(fragmentFile)
+	if err != nil {
+		checker.errors = append(checker.errors, &ConfigError{File: fragmentFile, Message: err.Error()})
+		return
+	}
+	fragmentChecker := newConfigChecker(fragmentFile, fileContent)
+	defer func() {
+		checker.errors = append(checker.errors, fragmentChecker.errors...)
+		for _, warning := range fragmentChecker.warnings {
+			checker.warnings = append(checker.warnings, fragmentFile+": "+warning)
+		}
+	}()
+	fragment, fragmentVersion := decodeConfig(fileContent, fragmentChecker, version)
+	if fragment == nil {
+		return
+	}
+	generatedNames := fragmentVersion == schemaVersion1
+	defaultSink(fragment)
+
+	// settings of the process belong to the main config
+	for _, section := range []struct {
+		key   string
+		value interface{}
+	}{{"storage", fragment.Storage}} {
+		value := reflect.ValueOf(section.value)
+		for i := 0; i < value.NumField(); i++ {
+			if !value.Field(i).IsZero() {
+				key := strings.Split(value.Type().Field(i).Tag.Get("yaml"), ",")[0]
+				fragmentChecker.add([]interface{}{section.key, key}, "only allowed in the main config")
+			}
+		}
+	}
+	if fragment.ShutdownTimeout != 0 {
+		fragmentChecker.add([]interface{}{"shutdown.timeout"}, "only allowed in the main config")
+	}
+	if len(fragment.Include) > 0 {
+		fragmentChecker.add([]interface{}{"include"}, "only allowed in the main config")
+	}
+
+	mapped := func(mergedPath string, fragmentPath ...interface{}) {
+		if checker.sources == nil {
+			checker.sources = make(map[string]fieldSource)
+		}
+		checker.sources[mergedPath] = fieldSource{checker: fragmentChecker, path: fragmentPath}
+	}
+	sinkNames := make(map[string]bool)
+	for _, sink := range config.Sinks.Loki {
+		sinkNames[sink.Name] = true
+	}
+	for _, sink := range config.Sinks.S3 {
+		sinkNames[sink.Name] = true
+	}
+	uniqueName := func(name string, used map[string]bool) string {
+		for n := 2; ; n++ {
+			if candidate := fmt.Sprintf("%s-%d", name, n); !used[candidate] {
+				return candidate
+			}
+		}
+	}
+
+	renamedSinks := make(map[string]string)
+	for i, sink := range fragment.Sinks.Loki {
+		if defined := findLokiSink(config.Sinks.Loki, sink.Name); defined != nil {
+			if *defined == sink {
+				continue
+			}
+			if generatedNames {
+				renamedSinks[sink.Name] = uniqueName("loki", sinkNames)
+				sink.Name = renamedSinks[sink.Name]
+			}
+		}
+		sinkNames[sink.Name] = true
+		mapped(fmt.Sprintf("sinks.loki[%d]", len(config.Sinks.Loki)), "sinks", "loki", i)
+		config.Sinks.Loki = append(config.Sinks.Loki, sink)
+	}
+	for i, sink := range fragment.Sinks.S3 {
+		duplicate := false
+		for _, defined := range config.Sinks.S3 {
+			duplicate = duplicate || defined == sink
+		}
+		if duplicate {
+			continue
+		}
+		if generatedNames && sinkNames[sink.Name] {
+			sink.Name = uniqueName("s3", sinkNames)
+		}
+		sinkNames[sink.Name] = true
+		mapped(fmt.Sprintf("sinks.s3[%d]", len(config.Sinks.S3)), "sinks", "s3", i)
+		config.Sinks.S3 = append(config.Sinks.S3, sink)
+	}
+
+	parserNames := make(map[string]bool)
+	for _, parser := range config.Parsers {
+		parserNames[parser.Name] = true
+	}
+	renamedParsers := make(map[string]string)
+	for i, parser := range fragment.Parsers {
+		duplicate := false
+		for _, defined := range config.Parsers {
+			duplicate = duplicate || reflect.DeepEqual(defined, parser)
+		}
+		if duplicate {
+			continue
+		}
+		if generatedNames && parserNames[parser.Name] {
+			renamedParsers[parser.Name] = uniqueName("parser", parserNames)
+			parser.Name = renamedParsers[parser.Name]
+		}
+		parserNames[parser.Name] = true
+		mapped(fmt.Sprintf("parsers[%d]", len(config.Parsers)), "parsers", i)
+		config.Parsers = append(config.Parsers, parser)
+	}
+
+	for l, listener := range fragment.Listeners {
+		for e := range listener.Endpoints {
+			endpoint := &listener.Endpoints[e]
+			if renamed, exists := renamedSinks[endpoint.Sink]; exists {
+				endpoint.Sink = renamed
+			}
+			if renamed, exists := renamedParsers[endpoint.Parser]; exists {
+				endpoint.Parser = renamed
+			}
+		}
+		merged := -1
+		for m, defined := range config.Listeners {
+			if listenerAddress(defined) == listenerAddress(listener) {
+				merged = m
+			}
+		}
+		if merged < 0 {
+			mapped(fmt.Sprintf("listeners[%d]", len(config.Listeners)), "listeners", l)
+			config.Listeners = append(config.Listeners, listener)
+			continue
+		}
+
+		// the listener of the address is shared, its settings must agree
+		defined := &config.Listeners[merged]
+		for _, setting := range []struct {
+			key     string
+			value   interface{}
+			defined interface{}
+			set     func()
+		}{
+			{"endpoint.health", listener.EndpointHealth, defined.EndpointHealth, func() { defined.EndpointHealth = listener.EndpointHealth }},
+			{"endpoint.ready", listener.EndpointReady, defined.EndpointReady, func() { defined.EndpointReady = listener.EndpointReady }},
+			{"endpoint.metrics", listener.EndpointMetrics, defined.EndpointMetrics, func() { defined.EndpointMetrics = listener.EndpointMetrics }},
+			{"max.upload.size", listener.MaxUploadSize, defined.MaxUploadSize, func() { defined.MaxUploadSize = listener.MaxUploadSize }},
+		} {
+			if reflect.ValueOf(setting.value).IsZero() {
+				continue
+			}
+			if reflect.ValueOf(setting.defined).IsZero() {
+				setting.set()
+				mapped(fmt.Sprintf("listeners[%d].%s", merged, setting.key), "listeners", l, setting.key)
+				continue
+			}
+			if setting.value != setting.defined {
+				fragmentChecker.add([]interface{}{"listeners", l, setting.key}, "%s [%v] conflicts with [%v] of address [%s] in %s",
+					setting.key, setting.value, setting.defined, listenerAddress(listener), checker.origin([]interface{}{"listeners", merged, setting.key}))
+			}
+		}
+		if len(listener.TrustedProxies) > 0 {
+			if len(defined.TrustedProxies) == 0 {
+				defined.TrustedProxies = listener.TrustedProxies
+				mapped(fmt.Sprintf("listeners[%d].trusted.proxies", merged), "listeners", l, "trusted.proxies")
+			} else if !reflect.DeepEqual(defined.TrustedProxies, listener.TrustedProxies) {
+				fragmentChecker.add([]interface{}{"listeners", l, "trusted.proxies"}, "trusted.proxies of address [%s] conflict with the ones in %s",
+					listenerAddress(listener), checker.origin([]interface{}{"listeners", merged, "trusted.proxies"}))
+			}
+		}
+		if listener.TLS != nil {
+			if defined.TLS == nil {
+				defined.TLS = listener.TLS
+				mapped(fmt.Sprintf("listeners[%d].tls", merged), "listeners", l, "tls")
+			} else if !reflect.DeepEqual(defined.TLS, listener.TLS) {
+				fragmentChecker.add([]interface{}{"listeners", l, "tls"}, "tls of address [%s] conflicts with the one in %s",
+					listenerAddress(listener), checker.origin([]interface{}{"listeners", merged, "tls"}))
+			}
+		}
+		for e, endpoint := range listener.Endpoints {
+			mapped(fmt.Sprintf("listeners[%d].endpoints[%d]", merged, len(defined.Endpoints)), "listeners", l, "endpoints", e)
+			defined.Endpoints = append(defined.Endpoints, endpoint)
+		}
+	}
+}
+
+// defaultSink endpoints without sink use the only loki sink of their file, other files may add sinks
+func defaultSink(config *Config) {
+	if len(config.Sinks.Loki) != 1 {
+		return
+	}
+	for l := range config.Listeners {
+		for e := range config.Listeners[l].Endpoints {
+			if endpoint := &config.Listeners[l].Endpoints[e]; endpoint.Sink == "" {
+				endpoint.Sink = config.Sinks.Loki[0].Name
+			}
+		}
+	}
+}
+
+func findLokiSink(sinks []ConfigLokiSink, name string) *ConfigLokiSink {
+	for i := range sinks {
+		if sinks[i].Name == name {
+			return &sinks[i]
+		}
+	}
+	return nil
+}
+
+// listenerAddress address of the listener with the default
+func listenerAddress(listener ConfigListener) string {
+	if listener.Address == "" {
+		return defaultAddress
+	}
+	return listener.Address
+}
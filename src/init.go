@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Profiles of molog init
+const (
+	initProfileMinimal     = "minimal"
+	initProfileS3          = "s3"
+	initProfileMultiTenant = "multi-tenant"
+	initProfileTLS         = "tls"
+)
+
+var initProfiles = []string{initProfileMinimal, initProfileS3, initProfileMultiTenant, initProfileTLS}
+
+// InitOptions values of the generated config, empty values get the defaults of initDefaults
+type InitOptions struct {
+	Profile     string
+	Address     string
+	UploadPath  string
+	LokiURL     string
+	S3Endpoint  string
+	S3Bucket    string
+	TLSCertFile string
+	TLSKeyFile  string
+	JWKSURL     string
+	JWTIssuer   string
+}
+
+var initDefaults = InitOptions{
+	Profile:     initProfileMinimal,
+	Address:     defaultAddress,
+	UploadPath:  "/api/v1",
+	LokiURL:     "http://loki:3100/loki/api/v1/push",
+	S3Endpoint:  "minio:9000",
+	S3Bucket:    "molog",
+	TLSCertFile: "molog.crt",
+	TLSKeyFile:  "molog.key",
+	JWKSURL:     "https://auth.example.com/.well-known/jwks.json",
+	JWTIssuer:   "https://auth.example.com/",
+}
+
+// initPrompt value asked by molog init -prompt, only for the listed profiles (all when empty)
+type initPrompt struct {
+	label    string
+	value    func(options *InitOptions) *string
+	profiles []string
+}
+
+var initPrompts = []initPrompt{
+	{"Profile (" + strings.Join(initProfiles, ", ") + ")", func(options *InitOptions) *string { return &options.Profile }, nil},
+	{"Listen address", func(options *InitOptions) *string { return &options.Address }, nil},
+	{"Upload path", func(options *InitOptions) *string { return &options.UploadPath }, nil},
+	{"Loki push URL", func(options *InitOptions) *string { return &options.LokiURL }, nil},
+	{"S3 endpoint", func(options *InitOptions) *string { return &options.S3Endpoint }, []string{initProfileS3}},
+	{"S3 bucket", func(options *InitOptions) *string { return &options.S3Bucket }, []string{initProfileS3}},
+	{"TLS certificate file", func(options *InitOptions) *string { return &options.TLSCertFile }, []string{initProfileTLS}},
+	{"TLS key file", func(options *InitOptions) *string { return &options.TLSKeyFile }, []string{initProfileTLS}},
+	{"JWKS URL of the token issuer", func(options *InitOptions) *string { return &options.JWKSURL }, []string{initProfileMultiTenant}},
+	{"Token issuer", func(options *InitOptions) *string { return &options.JWTIssuer }, []string{initProfileMultiTenant}},
+}
+
+// Prompt asks the values not given yet, an empty answer takes the default shown in brackets
+func (options *InitOptions) Prompt(in io.Reader, out io.Writer) error {
+	reader := bufio.NewReader(in)
+	for _, prompt := range initPrompts {
+		if len(prompt.profiles) > 0 && !contains(prompt.profiles, options.Profile) {
+			continue
+		}
+		value := prompt.value(options)
+		if *value != "" {
+			continue
+		}
+		fmt.Fprintf(out, "%s [%s]: ", prompt.label, *prompt.value(&initDefaults))
+		answer, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		*value = strings.TrimSpace(answer)
+		if *value == "" {
+			*value = *prompt.value(&initDefaults)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NewInitConfig config of the profile, omitted options take the defaults
+func NewInitConfig(options InitOptions) (*Config, error) {
+	for _, prompt := range initPrompts {
+		if value := prompt.value(&options); *value == "" {
+			*value = *prompt.value(&initDefaults)
+		}
+	}
+	if !contains(initProfiles, options.Profile) {
+		return nil, fmt.Errorf("unknown profile [%s], must be one of %s", options.Profile, strings.Join(initProfiles, ", "))
+	}
+	if lokiURL, err := url.Parse(options.LokiURL); err != nil || (lokiURL.Scheme != "http" && lokiURL.Scheme != "https") || lokiURL.Host == "" {
+		return nil, fmt.Errorf("Loki push URL [%s] must be an http or https URL", options.LokiURL)
+	}
+
+	endpoint := ConfigEndpoint{
+		EndpointUpload: options.UploadPath,
+		Sink:           "loki",
+	}
+	config := &Config{
+		SchemaVersion: schemaVersion2,
+		Sinks: ConfigSinks{
+			Loki: []ConfigLokiSink{{Name: "loki", URL: options.LokiURL}},
+		},
+	}
+	switch options.Profile {
+	case initProfileS3:
+		config.Sinks.S3 = []ConfigS3Sink{{
+			Name:     "archive",
+			Endpoint: options.S3Endpoint,
+			Bucket:   options.S3Bucket,
+			// credentials are given by the environment, empty ones are fine for anonymous access
+			AccessKeyID:     "${S3_ACCESS_KEY_ID:-}",
+			SecretAccessKey: "${S3_SECRET_ACCESS_KEY:-}",
+		}}
+	case initProfileMultiTenant:
+		// tenant of the Loki pushes is taken from the access token, limits apply per client
+		endpoint.AuthJWT = &ConfigJWT{
+			JWKSURL:     options.JWKSURL,
+			Issuer:      options.JWTIssuer,
+			Audience:    "molog",
+			Claims:      map[string]string{"user": "sub"},
+			TenantClaim: "tenant",
+		}
+		endpoint.RateLimitKey = rateLimitKeyPrincipal
+		endpoint.RateLimitRequests = 10
+		endpoint.QuotaDailyBytes = 1 << 30
+	}
+	config.Listeners = []ConfigListener{{
+		Address:       options.Address,
+		MaxUploadSize: defaultMaxUploadSize,
+		Endpoints:     []ConfigEndpoint{endpoint},
+	}}
+	if options.Profile == initProfileTLS {
+		config.Listeners[0].TLS = &ConfigTLS{
+			CertFile:   options.TLSCertFile,
+			KeyFile:    options.TLSKeyFile,
+			MinVersion: "1.2",
+		}
+	}
+	return config, nil
+}
+
+// GenerateConfig YAML of the profile config, it is validated as the file would be.
+// Warnings name files the config refers to that don't exist yet (certificates of the tls profile).
+func GenerateConfig(filename string, options InitOptions) ([]byte, []string, error) {
+	config, err := NewInitConfig(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	var generated bytes.Buffer
+	fmt.Fprintf(&generated, "# generated by molog init, see molog -init for the commented template of all settings\n")
+	fmt.Fprintf(&generated, "# and molog config-schema for the JSON Schema of the file\n")
+	encoder := yamlv3.NewEncoder(&generated)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return nil, nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, nil, err
+	}
+	warnings, err := checkConfigContent(filename, generated.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return generated.Bytes(), warnings, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// secretFilePrefix string value of the form file:<path> is replaced by the content of the file
+const secretFilePrefix = "file:"
+
+// redactedValue replaces secret values in the config dump
+const redactedValue = "<redacted>"
+
+// ${VAR}, ${VAR:-default} and $${ (escaped, kept as literal ${)
+var rexEnvReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// Keys of secret values, client configs passed to promtail and S3 are matched by rexSecretKey
+var secretConfigKeys = map[string]bool{
+	"key":                    true,
+	"auth.signed.url.secret": true,
+	"access.key.id":          true,
+	"secret.access.key":      true,
+}
+var rexSecretKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|private)`)
+
+// isSecretKey reports whether the value of the key must not be logged, file and env references are not secrets
+func isSecretKey(key string) bool {
+	if strings.HasSuffix(key, ".file") || strings.HasSuffix(key, ".env") || strings.HasSuffix(key, ".claim") {
+		return false
+	}
+	return secretConfigKeys[key] || rexSecretKey.MatchString(key)
+}
+
+// interpolateString replaces environment variable references and file: secret reference
+func interpolateString(value string) (string, error) {
+	var missing []string
+	value = rexEnvReference.ReplaceAllStringFunc(value, func(reference string) string {
+		if reference == "$${" {
+			return "${"
+		}
+		subMatch := rexEnvReference.FindStringSubmatch(reference)
+		hasDefault := strings.Contains(reference, ":-")
+		if envValue, exists := os.LookupEnv(subMatch[1]); exists && (envValue != "" || !hasDefault) {
+			return envValue
+		}
+		if hasDefault {
+			return subMatch[2]
+		}
+		missing = append(missing, subMatch[1])
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	if strings.HasPrefix(value, secretFilePrefix) {
+		content, err := os.ReadFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", fmt.Errorf("can't read secret file: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// interpolate replaces references in all string values of the decoded config, field paths follow yaml tags
+func (checker *configChecker) interpolate(value reflect.Value, fieldPath []interface{}) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return
+		}
+		if value.Kind() == reflect.Interface {
+			// values of untyped maps are replaced as a whole
+			elem := reflect.New(value.Elem().Type()).Elem()
+			elem.Set(value.Elem())
+			checker.interpolate(elem, fieldPath)
+			if value.CanSet() {
+				value.Set(elem)
+			}
+			return
+		}
+		checker.interpolate(value.Elem(), fieldPath)
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			checker.interpolate(value.Field(i), append(fieldPath[:len(fieldPath):len(fieldPath)], name))
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			checker.interpolate(value.Index(i), append(fieldPath[:len(fieldPath):len(fieldPath)], i))
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			elem := reflect.New(value.Type().Elem()).Elem()
+			elem.Set(value.MapIndex(key))
+			checker.interpolate(elem, append(fieldPath[:len(fieldPath):len(fieldPath)], fmt.Sprintf("%v", key.Interface())))
+			value.SetMapIndex(key, elem)
+		}
+	case reflect.String:
+		interpolated, err := interpolateString(value.String())
+		if err != nil {
+			checker.add(fieldPath, "%v", err)
+			return
+		}
+		value.SetString(interpolated)
+	}
+}
+
+// redactConfig the config file for the log. Values of secret keys and values with ${ENV} or file: references are
+// replaced, the references may resolve to secrets. URLs are logged without user and password.
+func redactConfig(content []byte) string {
+	var document yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &document); err != nil {
+		return fmt.Sprintf("<config can't be parsed: %v>", err)
+	}
+	redactNode(&document, false)
+	var redacted strings.Builder
+	encoder := yamlv3.NewEncoder(&redacted)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return fmt.Sprintf("<config can't be printed: %v>", err)
+	}
+	return redacted.String()
+}
+
+// redactNode redacts the node and its children, secret tells the node is the value of a secret key
+func redactNode(node *yamlv3.Node, secret bool) {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			redactNode(node.Content[i+1], isSecretKey(node.Content[i].Value))
+		}
+	case yamlv3.ScalarNode:
+		if secret || isInterpolated(node.Value) {
+			node.Value = redactedValue
+			node.Tag = "!!str"
+			node.Style = 0
+			return
+		}
+		if strings.Contains(node.Value, "://") {
+			if parsedURL, err := url.Parse(node.Value); err == nil && parsedURL.User != nil {
+				parsedURL.User = nil
+				node.Value = parsedURL.String()
+			}
+		}
+	default:
+		for _, child := range node.Content {
+			redactNode(child, secret)
+		}
+	}
+}
+
+// isInterpolated reports whether the value has ${ENV} or file: references
+func isInterpolated(value string) bool {
+	return strings.HasPrefix(value, secretFilePrefix) || strings.Contains(strings.ReplaceAll(value, "$${", ""), "${")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Go duration as accepted by time.ParseDuration
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// Values of the fields the JSON Schema restricts beyond their type, by type and field name
+var jsonSchemaEnums = map[string][]string{
+	"Config.SchemaVersion": {schemaVersion2},
+	"ConfigTLS.ClientAuth": {"require", "optional"},
+	"ConfigTLS.MinVersion": tlsVersionNames(),
+
+	"ConfigQueryParam.Target": {queryTargetLabel, queryTargetMetadata, queryTargetDrop},
+}
+var jsonSchemaPatterns = map[string]string{
+	"ConfigEndpoint.RateLimitKey": `^(ip|principal|label:.+)$`,
+}
+
+// ConfigJSONSchema JSON Schema of the config file of schema 2.0 for editor completion,
+// generated from the yaml tags so it follows the Config types
+func ConfigJSONSchema() map[string]interface{} {
+	schema := jsonSchemaOf(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "MoLog config " + schemaVersion2
+	return schema
+}
+
+func jsonSchemaOf(valueType reflect.Type) map[string]interface{} {
+	if valueType == reflect.TypeOf(time.Duration(0)) {
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	}
+	switch valueType.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaOf(valueType.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaOf(valueType.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaOf(valueType.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			tag := strings.Split(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || tag[0] == "" || tag[0] == "-" {
+				continue
+			}
+			property := jsonSchemaOf(field.Type)
+			key := valueType.Name() + "." + field.Name
+			if enum, exists := jsonSchemaEnums[key]; exists {
+				property["enum"] = enum
+			}
+			if pattern, exists := jsonSchemaPatterns[key]; exists {
+				property["pattern"] = pattern
+			}
+			properties[tag[0]] = property
+			if len(tag) == 1 {
+				required = append(required, tag[0])
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
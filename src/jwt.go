@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LokiTenantHeader header of the Loki tenant (org) of the push
+const LokiTenantHeader = "X-Scope-OrgID"
+
+// JWKS of the URL is refreshed every jwksRefreshInterval, unknown key id refreshes it not more often than jwksMinRefreshInterval
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+	jwksFetchTimeout       = 10 * time.Second
+)
+
+// Clock skew allowed for exp and nbf
+const jwtLeeway = 30 * time.Second
+
+var errJWTExpired = errors.New("token expired")
+
+// ConfigJWT JWT bearer token YAML of the upload endpoint
+type ConfigJWT struct {
+	JWKSFile    string            `yaml:"jwks.file,omitempty"`
+	JWKSURL     string            `yaml:"jwks.url,omitempty"`
+	Issuer      string            `yaml:"issuer,omitempty"`
+	Audience    string            `yaml:"audience,omitempty"`
+	Claims      map[string]string `yaml:"claims,omitempty"`
+	TenantClaim string            `yaml:"tenant.claim,omitempty"`
+}
+
+// JWTValidator validates bearer tokens by keys of the JWKS
+type JWTValidator struct {
+	Issuer      string
+	Audience    string
+	Claims      map[string]string
+	TenantClaim string
+
+	jwksURL   string
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	fetching  chan struct{} // closed when the running fetch is done
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWTValidator loads the JWKS file, JWKS URL is fetched on the first token
+func NewJWTValidator(jwtConfig ConfigJWT) (*JWTValidator, error) {
+	if (jwtConfig.JWKSFile == "") == (jwtConfig.JWKSURL == "") {
+		return nil, fmt.Errorf("one of jwks.file and jwks.url must be defined")
+	}
+	if jwtConfig.Audience == "" || jwtConfig.Issuer == "" {
+		return nil, fmt.Errorf("issuer and audience must be defined")
+	}
+	if err := checkLabelNames(jwtConfig.Claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	validator := &JWTValidator{
+		Issuer:      jwtConfig.Issuer,
+		Audience:    jwtConfig.Audience,
+		Claims:      jwtConfig.Claims,
+		TenantClaim: jwtConfig.TenantClaim,
+		jwksURL:     jwtConfig.JWKSURL,
+	}
+	if jwtConfig.JWKSFile != "" {
+		content, err := os.ReadFile(jwtConfig.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		if validator.keys, err = parseJWKS(content); err != nil {
+			return nil, fmt.Errorf("%s: %v", jwtConfig.JWKSFile, err)
+		}
+	}
+	return validator, nil
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// parseJWKS public keys by key id, keys of unsupported types or for encryption are ignored
+func parseJWKS(content []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key [%s]: %v", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys")
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return key, nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+// key public key by id, the JWKS URL is fetched when it is stale or doesn't know the key id.
+// The fetch runs without the lock, requests of an unknown key id wait for it.
+func (validator *JWTValidator) key(kid string) (crypto.PublicKey, error) {
+	validator.mu.Lock()
+	key, exists := validator.keys[kid]
+	if validator.jwksURL == "" {
+		validator.mu.Unlock()
+		if !exists {
+			return nil, fmt.Errorf("unknown key id [%s]", kid)
+		}
+		return key, nil
+	}
+	sinceFetch := time.Since(validator.fetchedAt)
+	if validator.fetching == nil && (sinceFetch > jwksRefreshInterval || !exists && sinceFetch > jwksMinRefreshInterval) {
+		fetching := make(chan struct{})
+		validator.fetching = fetching
+		validator.fetchedAt = time.Now()
+		validator.mu.Unlock()
+		keys, err := validator.fetch()
+		validator.mu.Lock()
+		validator.fetching = nil
+		close(fetching)
+		if err != nil {
+			validator.mu.Unlock()
+			if !exists {
+				return nil, err
+			}
+			// stale keys are better than none
+			return key, nil
+		}
+		validator.keys = keys
+	} else if validator.fetching != nil && !exists {
+		fetching := validator.fetching
+		validator.mu.Unlock()
+		<-fetching
+		validator.mu.Lock()
+	}
+	key, exists = validator.keys[kid]
+	validator.mu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown key id [%s]", kid)
+	}
+	return key, nil
+}
+
+// fetch keys of the JWKS URL
+func (validator *JWTValidator) fetch() (map[string]crypto.PublicKey, error) {
+	client := http.Client{Timeout: jwksFetchTimeout}
+	response, err := client.Get(validator.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch JWKS: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't fetch JWKS: %s returned status %d", validator.jwksURL, response.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch JWKS: %v", err)
+	}
+	keys, err := parseJWKS(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %v", validator.jwksURL, err)
+	}
+	return keys, nil
+}
+
+// verifySignature checks the signature of the signing input by the algorithm of the token header
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	valid := false
+	switch alg {
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			valid = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+		}
+	case "ES256":
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			valid = ecdsa.Verify(ecKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+		}
+	case "EdDSA":
+		if edKey, ok := key.(ed25519.PublicKey); ok {
+			valid = ed25519.Verify(edKey, []byte(signingInput), signature)
+		}
+	default:
+		return fmt.Errorf("algorithm %s is not allowed", alg)
+	}
+	if !valid {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// claimString string value of the claim, numbers and booleans are formatted
+func claimString(claims map[string]interface{}, name string) string {
+	switch value := claims[name].(type) {
+	case string:
+		return value
+	case nil:
+		return ""
+	case json.Number:
+		return value.String()
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+func (validator *JWTValidator) hasAudience(claims map[string]interface{}) bool {
+	switch audience := claims["aud"].(type) {
+	case string:
+		return audience == validator.Audience
+	case []interface{}:
+		for _, value := range audience {
+			if value == validator.Audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate validates the token, mapped claims become labels of the principal
+func (validator *JWTValidator) Authenticate(token string, now time.Time) (*Principal, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", errInvalidCredentials)
+	}
+	headerJSON, err := decodeSegment(segments[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token header", errInvalidCredentials)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed token header", errInvalidCredentials)
+	}
+	signature, err := decodeSegment(segments[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token signature", errInvalidCredentials)
+	}
+	key, err := validator.key(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+	}
+	if err := verifySignature(header.Alg, key, segments[0]+"."+segments[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+	}
+
+	claimsJSON, err := decodeSegment(segments[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", errInvalidCredentials)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(claimsJSON)))
+	decoder.UseNumber()
+	var claims map[string]interface{}
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", errInvalidCredentials)
+	}
+	expires, ok := claimTime(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("%w: token has no exp", errInvalidCredentials)
+	}
+	if now.After(expires.Add(jwtLeeway)) {
+		return nil, errJWTExpired
+	}
+	if notBefore, ok := claimTime(claims, "nbf"); ok && now.Add(jwtLeeway).Before(notBefore) {
+		return nil, fmt.Errorf("%w: token is not valid yet", errInvalidCredentials)
+	}
+	if claimString(claims, "iss") != validator.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %s", errInvalidCredentials, claimString(claims, "iss"))
+	}
+	if !validator.hasAudience(claims) {
+		return nil, fmt.Errorf("%w: token isn't issued for %s", errInvalidCredentials, validator.Audience)
+	}
+
+	principal := &Principal{
+		Name:   claimString(claims, "sub"),
+		Labels: make(map[string]string, len(validator.Claims)),
+	}
+	// a mapped claim missing in the token fails the request so the client can't set the label by query
+	for label, claim := range validator.Claims {
+		value := claimString(claims, claim)
+		if value == "" {
+			return nil, fmt.Errorf("%w: token has no %s", errInvalidCredentials, claim)
+		}
+		principal.Labels[label] = value
+	}
+	if validator.TenantClaim != "" {
+		if principal.Tenant = claimString(claims, validator.TenantClaim); principal.Tenant == "" {
+			return nil, fmt.Errorf("%w: token has no %s", errInvalidCredentials, validator.TenantClaim)
+		}
+	}
+	return principal, nil
+}
+
+// bearerToken token of the Authorization header
+func bearerToken(request *http.Request) (string, bool) {
+	authorization := request.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:]), true
+	}
+	return "", false
+}
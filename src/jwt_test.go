@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://auth.example.com"
+	testAudience = "molog"
+)
+
+type testKey struct {
+	kid     string
+	private ed25519.PrivateKey
+}
+
+func newTestKey(t *testing.T, kid string) testKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, private: private}
+}
+
+// jwks JWKS document of the public keys
+func jwks(keys ...testKey) []byte {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, jsonWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			Kid: key.kid,
+			X:   base64.RawURLEncoding.EncodeToString(key.private.Public().(ed25519.PublicKey)),
+		})
+	}
+	content, _ := json.Marshal(jwks)
+	return content
+}
+
+// sign token of the claims signed by the key, the header has the algorithm alg
+func (key testKey) sign(alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": key.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key.private, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    testIssuer,
+		"aud":    testAudience,
+		"sub":    "device-1",
+		"exp":    now.Add(time.Hour).Unix(),
+		"nbf":    now.Add(-time.Minute).Unix(),
+		"tenant": "acme",
+		"app":    "crm",
+	}
+}
+
+func newTestValidator(t *testing.T, jwksURL string, keys ...testKey) *JWTValidator {
+	jwtConfig := ConfigJWT{
+		JWKSURL:     jwksURL,
+		Issuer:      testIssuer,
+		Audience:    testAudience,
+		Claims:      map[string]string{"app": "app"},
+		TenantClaim: "tenant",
+	}
+	if jwksURL == "" {
+		jwtConfig.JWKSFile = t.TempDir() + "/jwks.json"
+		if err := os.WriteFile(jwtConfig.JWKSFile, jwks(keys...), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	validator, err := NewJWTValidator(jwtConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return validator
+}
+
+func TestJWTValid(t *testing.T) {
+	key := newTestKey(t, "k1")
+	validator := newTestValidator(t, "", key)
+	now := time.Now()
+	principal, err := validator.Authenticate(key.sign("EdDSA", testClaims(now)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "device-1" || principal.Tenant != "acme" || principal.Labels["app"] != "crm" {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+
+	claims := testClaims(now)
+	claims["aud"] = []string{"other", testAudience}
+	if _, err := validator.Authenticate(key.sign("EdDSA", claims), now); err != nil {
+		t.Fatalf("audience list: %v", err)
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	key := newTestKey(t, "k1")
+	validator := newTestValidator(t, "", key)
+	now := time.Now()
+	for _, test := range []struct {
+		name  string
+		alg   string
+		claim string
+		value interface{}
+		err   string
+	}{
+		{"alg none", "none", "", nil, "algorithm none is not allowed"},
+		{"alg HS256", "HS256", "", nil, "algorithm HS256 is not allowed"},
+		{"alg of other key type", "RS256", "", nil, "signature mismatch"},
+		{"expired", "EdDSA", "exp", now.Add(-time.Minute).Unix(), "token expired"},
+		{"no exp", "EdDSA", "exp", nil, "token has no exp"},
+		{"not valid yet", "EdDSA", "nbf", now.Add(time.Minute).Unix(), "token is not valid yet"},
+		{"issuer", "EdDSA", "iss", "https://evil.example.com", "unexpected issuer"},
+		{"audience", "EdDSA", "aud", "other", "token isn't issued for molog"},
+		{"missing mapped claim", "EdDSA", "app", nil, "token has no app"},
+		{"missing tenant", "EdDSA", "tenant", nil, "token has no tenant"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			claims := testClaims(now)
+			if test.claim != "" {
+				claims[test.claim] = test.value
+				if test.value == nil {
+					delete(claims, test.claim)
+				}
+			}
+			_, err := validator.Authenticate(key.sign(test.alg, claims), now)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want %s", err, test.err)
+			}
+			if !errors.Is(err, errInvalidCredentials) && !errors.Is(err, errJWTExpired) {
+				t.Fatalf("error %v is not a credentials error", err)
+			}
+		})
+	}
+
+	// within the leeway the token is still accepted
+	claims := testClaims(now)
+	claims["exp"] = now.Add(-jwtLeeway / 2).Unix()
+	if _, err := validator.Authenticate(key.sign("EdDSA", claims), now); err != nil {
+		t.Fatalf("exp within leeway: %v", err)
+	}
+
+	tampered := key.sign("EdDSA", testClaims(now))
+	segments := strings.Split(tampered, ".")
+	claims = testClaims(now)
+	claims["app"] = "evil"
+	payload, _ := json.Marshal(claims)
+	segments[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := validator.Authenticate(strings.Join(segments, "."), now); err == nil || !strings.Contains(err.Error(), "signature mismatch") {
+		t.Fatalf("tampered claims: error %v", err)
+	}
+
+	other := newTestKey(t, "k2")
+	if _, err := validator.Authenticate(other.sign("EdDSA", testClaims(now)), now); err == nil || !strings.Contains(err.Error(), "unknown key id [k2]") {
+		t.Fatalf("unknown key: error %v", err)
+	}
+}
+
+func TestJWTUnknownKeyRefetch(t *testing.T) {
+	key1 := newTestKey(t, "k1")
+	key2 := newTestKey(t, "k2")
+	var served atomic.Pointer[[]byte]
+	var fetches atomic.Int32
+	content := jwks(key1)
+	served.Store(&content)
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		fetches.Add(1)
+		responseWriter.Write(*served.Load())
+	}))
+	defer server.Close()
+	validator := newTestValidator(t, server.URL)
+	now := time.Now()
+
+	if _, err := validator.Authenticate(key1.sign("EdDSA", testClaims(now)), now); err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 1 {
+		t.Fatalf("%d fetches, want 1", fetches.Load())
+	}
+
+	// the issuer rotated its keys, the unknown key id is fetched right after the first fetch only once
+	content = jwks(key1, key2)
+	served.Store(&content)
+	if _, err := validator.Authenticate(key2.sign("EdDSA", testClaims(now)), now); err == nil {
+		t.Fatal("unknown key id accepted before the minimum refresh interval")
+	}
+	if fetches.Load() != 1 {
+		t.Fatalf("%d fetches, want 1", fetches.Load())
+	}
+
+	validator.mu.Lock()
+	validator.fetchedAt = time.Now().Add(-jwksMinRefreshInterval - time.Second)
+	validator.mu.Unlock()
+	if _, err := validator.Authenticate(key2.sign("EdDSA", testClaims(now)), now); err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 2 {
+		t.Fatalf("%d fetches, want 2", fetches.Load())
+	}
+	if _, err := validator.Authenticate(key1.sign("EdDSA", testClaims(now)), now); err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 2 {
+		t.Fatalf("%d fetches, want 2, known key id refetched", fetches.Load())
+	}
+}
+
+func TestJWTFetchWithoutLock(t *testing.T) {
+	key1 := newTestKey(t, "k1")
+	key2 := newTestKey(t, "k2")
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		responseWriter.Write(jwks(key1, key2))
+	}))
+	defer server.Close()
+	defer close(release)
+	validator := newTestValidator(t, server.URL)
+	now := time.Now()
+	if _, err := validator.Authenticate(key1.sign("EdDSA", testClaims(now)), now); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale JWKS is refetched by one request, the others keep validating with the known keys
+	validator.mu.Lock()
+	validator.fetchedAt = time.Now().Add(-jwksRefreshInterval - time.Second)
+	validator.mu.Unlock()
+	go validator.Authenticate(key1.sign("EdDSA", testClaims(now)), now)
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := validator.Authenticate(key1.sign("EdDSA", testClaims(now)), now)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("known key id waits for the JWKS fetch")
+	}
+	if fetches.Load() != 2 {
+		t.Fatalf("%d fetches, want 2", fetches.Load())
+	}
+}
+
+func TestJWTConfig(t *testing.T) {
+	for _, test := range []struct {
+		config ConfigJWT
+		err    string
+	}{
+		{ConfigJWT{Issuer: testIssuer, Audience: testAudience}, "one of jwks.file and jwks.url must be defined"},
+		{ConfigJWT{JWKSURL: "http://127.0.0.1/jwks", Audience: testAudience}, "issuer and audience must be defined"},
+		{ConfigJWT{JWKSURL: "http://127.0.0.1/jwks", Issuer: testIssuer, Audience: testAudience, Claims: map[string]string{"app-id": "app"}},
+			"claims: invalid label name [app-id]"},
+	} {
+		_, err := NewJWTValidator(test.config)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%+v: error %v, want %s", test.config, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	escape "molog/utils"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Sources of templated label values, e.g. device: "{filename.device}" or build: "{header.X-App-Build}"
+const (
+	labelSourceFilename = "filename."
+	labelSourceHeader   = "header."
+	labelSourceClientIP = "client.ip"
+	labelSourceUploadID = "upload.id"
+)
+
+// Labels of every pushed line, the endpoint can't define them
+var lineLabels = []string{"level", "tag", "source"}
+
+var rexLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var rexLabelPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// EndpointLabel label of the endpoint config, static when the value has no placeholders
+type EndpointLabel struct {
+	Name     string
+	Value    string
+	Template bool
+	Volatile bool // the value differs per upload ({upload.id}, {client.ip}), it doesn't identify the device
+}
+
+// LabelContext values of the upload the label templates are filled from
+type LabelContext struct {
+	Filename map[string]string
+	Header   http.Header
+	ClientIP string
+	UploadID string
+}
+
+// NewEndpointLabels validates the labels of the endpoint, filename groups must be groups of the filename pattern
+func NewEndpointLabels(labels map[string]string, filenamePattern *regexp.Regexp) ([]EndpointLabel, map[string]error) {
+	filenameGroups := make(map[string]bool)
+	if filenamePattern != nil {
+		for _, name := range filenamePattern.SubexpNames() {
+			filenameGroups[name] = name != "" && !filenameTimeGroups[name]
+		}
+	}
+	errs := make(map[string]error)
+	endpointLabels := make([]EndpointLabel, 0, len(labels))
+	for name, value := range labels {
+		if !rexLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			errs[name] = fmt.Errorf("invalid label name [%s]", name)
+			continue
+		}
+		if contains(lineLabels, name) {
+			errs[name] = fmt.Errorf("label [%s] is set per line, it can't be defined", name)
+			continue
+		}
+		label := EndpointLabel{Name: name, Value: value}
+		for _, subMatch := range rexLabelPlaceholder.FindAllStringSubmatch(value, -1) {
+			label.Template = true
+			source := subMatch[1]
+			switch {
+			case source == labelSourceClientIP || source == labelSourceUploadID:
+				label.Volatile = true
+			case strings.HasPrefix(source, labelSourceHeader) && len(source) > len(labelSourceHeader):
+			case strings.HasPrefix(source, labelSourceFilename) && filenameGroups[strings.TrimPrefix(source, labelSourceFilename)]:
+			case strings.HasPrefix(source, labelSourceFilename):
+				errs[name] = fmt.Errorf("filename.pattern has no group [%s]", strings.TrimPrefix(source, labelSourceFilename))
+			default:
+				errs[name] = fmt.Errorf("unknown placeholder {%s}, must be filename.<group>, header.<name>, %s or %s",
+					source, labelSourceClientIP, labelSourceUploadID)
+			}
+		}
+		if errs[name] == nil {
+			endpointLabels = append(endpointLabels, label)
+		}
+	}
+	sort.Slice(endpointLabels, func(i, j int) bool { return endpointLabels[i].Name < endpointLabels[j].Name })
+	return endpointLabels, errs
+}
+
+// Values labels of the upload, labels with an empty value (e.g. missing header) are left out
+func (context *LabelContext) Values(labels []EndpointLabel) map[string]string {
+	values := make(map[string]string, len(labels))
+	for _, label := range labels {
+		value := label.Value
+		if label.Template {
+			value = rexLabelPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+				return context.value(placeholder[1 : len(placeholder)-1])
+			})
+		}
+		if value != "" {
+			values[label.Name] = value
+		}
+	}
+	return values
+}
+
+// deviceLabels labels identifying the device of the upload, without the labels of the endpoint
+// that differ per upload
+func (promtailConfig *MoLogPromtail) deviceLabels(streams map[string]*string) map[string]*string {
+	var deviceLabels map[string]*string
+	for _, label := range promtailConfig.Labels {
+		if label.Volatile {
+			if deviceLabels == nil {
+				deviceLabels = maps.Clone(streams)
+			}
+			delete(deviceLabels, label.Name)
+		}
+	}
+	if deviceLabels == nil {
+		return streams
+	}
+	return deviceLabels
+}
+
+// checkLabelNames error of the first invalid label name of the config, names of labels are not sanitised
+func checkLabelNames(labels map[string]string) error {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !rexLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name [%s]", name)
+		}
+	}
+	return nil
+}
+
+// setLabels sets the labels with sanitised names (app-id becomes app_id), they override the labels of
+// sources with lower precedence. A valid name wins over other names of the labels sanitised to it,
+// of several sanitised names the first in sorted order wins.
+func setLabels(streams map[string]*string, labels map[string]string) {
+	var sanitised []string
+	for name, value := range labels {
+		if escape.LabelName(name) != name {
+			sanitised = append(sanitised, name)
+			continue
+		}
+		value := value
+		streams[name] = &value
+	}
+	sort.Strings(sanitised)
+	set := make(map[string]bool, len(sanitised))
+	for _, name := range sanitised {
+		label := escape.LabelName(name)
+		if _, exists := labels[label]; exists || set[label] {
+			continue
+		}
+		set[label] = true
+		value := labels[name]
+		streams[label] = &value
+	}
+}
+
+func (context *LabelContext) value(source string) string {
+	switch {
+	case source == labelSourceClientIP:
+		return context.ClientIP
+	case source == labelSourceUploadID:
+		return context.UploadID
+	case strings.HasPrefix(source, labelSourceHeader):
+		return context.Header.Get(strings.TrimPrefix(source, labelSourceHeader))
+	case strings.HasPrefix(source, labelSourceFilename):
+		return context.Filename[strings.TrimPrefix(source, labelSourceFilename)]
+	}
+	return ""
+}
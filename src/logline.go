@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLine line of the mobile log format, e.g.
+// 00:09:58:096__FINE_____TAG_AuthManag            |﹏AuthManag <--
+type LogLine struct {
+	Hour, Minute, Second, Millisecond int
+
+	Level   string
+	Source  string
+	Tag     string
+	IsTag   bool
+	Message string
+}
+
+// Column positions of the mobile log format
+const (
+	logLineTimeEnd   = 12
+	logLineLevelFrom = 14
+	logLineLevelEnd  = 23
+	logLineSourceEnd = 48
+)
+
+func parseLogLine(line string) (LogLine, error) {
+	var logLine LogLine
+	if len(line) < logLineSourceEnd {
+		return logLine, fmt.Errorf("line is shorter than %d characters", logLineSourceEnd)
+	}
+	timestampTimeComponents := strings.Split(line[0:logLineTimeEnd], ":")
+	if len(timestampTimeComponents) != 4 {
+		return logLine, fmt.Errorf("failed parse timestamp %v", line[0:logLineTimeEnd])
+	}
+	timestampValues := make([]int, len(timestampTimeComponents))
+	for i, component := range timestampTimeComponents {
+		value, err := strconv.Atoi(component)
+		if err != nil {
+			return logLine, fmt.Errorf("failed parse timestamp %v: %v", line[0:logLineTimeEnd], err)
+		}
+		timestampValues[i] = value
+	}
+	logLine.Hour = timestampValues[0]
+	logLine.Minute = timestampValues[1]
+	logLine.Second = timestampValues[2]
+	logLine.Millisecond = timestampValues[3]
+	logLine.Level = strings.ReplaceAll(line[logLineLevelFrom:logLineLevelEnd], "_", "")
+	logLine.Source = strings.ReplaceAll(line[logLineLevelEnd:logLineSourceEnd], " ", "")
+	_, logLine.Tag, logLine.IsTag = strings.Cut(logLine.Source, "_")
+	logLine.Message = strings.TrimPrefix(line[logLineSourceEnd:], "|")
+	return logLine, nil
+}
+
+// Timestamp of the line on the base date of the upload
+func (logLine *LogLine) Timestamp(filenameInfo FilenameInfo) time.Time {
+	return filenameInfo.lineTimestamp(
+		logLine.Hour,
+		logLine.Minute,
+		logLine.Second,
+		logLine.Millisecond*int(time.Millisecond),
+	)
+}
+
+// recordHash identifies the record by timestamp, level, tag and message, regardless of the log file it came from
+func (logLine *LogLine) recordHash(timestamp time.Time) uint64 {
+	hash := fnv.New64a()
+	for _, field := range []string{strconv.FormatInt(timestamp.UnixNano(), 10), logLine.Level, logLine.Source, logLine.Message} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
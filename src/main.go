@@ -1,47 +1,224 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const productVersion = "1.0.1"
 const releaseTag = "sara adams"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-config" {
+		os.Exit(migrateConfigFile(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		os.Exit(initConfigFile(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config-schema" {
+		os.Exit(configSchema(os.Args[2:]))
+	}
 	configFile := flag.String("config", "config.yaml", "Config file location")
-	initiate := flag.Bool("init", false, "Create initial config file")
+	initiate := flag.Bool("init", false, "Create initial config file with all settings commented, see molog init -h for profiles")
 	version := flag.Bool("v", false, "Print product version")
+	watch := flag.Duration("watch", 0, "Reload the config when the file changes, checked with this interval (SIGHUP always reloads)")
+	signURL := flag.String("sign-url", "", "Print signed upload URL for the upload path with labels, e.g. /upload?employee=5")
+	signTTL := flag.Duration("sign-ttl", 15*time.Minute, "Validity of the signed upload URL")
+	signMaxSize := flag.Int64("sign-max-size", 0, "Upload size limit of the signed upload URL, 0 keeps the endpoint limit")
 	flag.Parse()
 
 	if *version {
 		fmt.Printf("MoLog %s (%s)\n", productVersion, releaseTag)
+	} else if *signURL != "" {
+		// stores are not needed to sign, the config isn't logged
+		moLogs, err := loadMoLog(*configFile, false)
+		if err != nil {
+			fmt.Printf("Invalid config %v:\n%v\n", *configFile, err)
+			os.Exit(1)
+		}
+		signedURL, err := signUploadURL(moLogs, *signURL, *signTTL, *signMaxSize)
+		if err != nil {
+			fmt.Printf("Can't sign URL %s :\n%v\n", *signURL, err)
+			os.Exit(1)
+		}
+		fmt.Println(signedURL)
 	} else if *initiate {
-		if _, err := os.Stat(*configFile); os.IsNotExist(err) {
-			if err := os.WriteFile(*configFile, []byte(initConfig), 0644); err == nil {
-				fmt.Printf("Config file %s successfully created.\n", *configFile)
-			} else {
-				fmt.Printf("Can't create config file %s :\n%v", *configFile, err)
+		writeInitConfig(*configFile, []byte(initConfig))
+	} else {
+		server := NewServer(*configFile)
+		if err := server.Apply(ReadMoLog(*configFile)); err != nil {
+			log.Fatalln(err)
+		}
+		if *watch > 0 {
+			go server.Watch(*watch)
+		}
+
+		var chExit = make(chan os.Signal, 1)
+		signal.Notify(chExit, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for received := range chExit {
+			if received == syscall.SIGHUP {
+				if err := server.Reload(); err != nil {
+					log.Printf("[ERROR] Config %v isn't reloaded, running config is kept: %v", *configFile, err)
+				}
+				continue
 			}
-		} else {
-			fmt.Printf("Config file %s already exists.\n", *configFile)
+			log.Printf("[INFO] %v received, shutting down", received)
+			server.Shutdown()
+			break
 		}
+	}
+}
+
+// checkConfig validates the config file, exit code is not zero when the config is invalid
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Config file location")
+	jsonOutput := flags.Bool("json", false, "Print errors as JSON")
+	flags.Parse(args)
+
+	err := CheckConfig(*configFile)
+	var configErrors ConfigErrors
+	var configError *ConfigError
+	if errors.As(err, &configError) {
+		configErrors = ConfigErrors{configError}
+	} else if err != nil && !errors.As(err, &configErrors) {
+		configErrors = ConfigErrors{{File: *configFile, Message: err.Error()}}
+	}
+	if *jsonOutput {
+		if configErrors == nil {
+			configErrors = ConfigErrors{}
+		}
+		payload, _ := json.MarshalIndent(configErrors, "", "  ")
+		fmt.Println(string(payload))
+	} else if len(configErrors) == 0 {
+		fmt.Printf("Config file %s is valid.\n", *configFile)
 	} else {
-		list := ReadMoLog(*configFile)
-		for i := range list {
-			go func(moLog *MoLog) {
-				err := moLog.Start()
-				if err != nil {
-					log.Fatalln(err)
-				}
-			}(list[i])
+		fmt.Println(configErrors.Error())
+	}
+	if len(configErrors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrateConfigFile writes the config upgraded to schema 2.0, by default the file is replaced and the original is kept with .v1 suffix
+func migrateConfigFile(args []string) int {
+	flags := flag.NewFlagSet("migrate-config", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Config file location")
+	outFile := flags.String("out", "", "Upgraded config file location, - prints it (default replaces the config file)")
+	flags.Parse(args)
+
+	migrated, warnings, err := MigrateConfig(*configFile)
+	// warnings explain settings missing in an invalid migrated config as well
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "[WARN] %v\n", warning)
+	}
+	if err != nil {
+		fmt.Printf("Can't migrate config file %s :\n%v\n", *configFile, err)
+		return 1
+	}
+	if *outFile == "-" {
+		os.Stdout.Write(migrated)
+		return 0
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(*configFile); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if *outFile == "" {
+		if err := os.Rename(*configFile, *configFile+".v1"); err != nil {
+			fmt.Printf("Can't keep the original config file %s :\n%v\n", *configFile, err)
+			return 1
 		}
+		*outFile = *configFile
+	}
+	if err := os.WriteFile(*outFile, migrated, mode); err != nil {
+		fmt.Printf("Can't write config file %s :\n%v\n", *outFile, err)
+		return 1
+	}
+	fmt.Printf("Config file %s migrated to schema %s in %s.\n", *configFile, schemaVersion2, *outFile)
+	return 0
+}
 
-		var chExit = make(chan os.Signal, 1)
-		signal.Notify(chExit, os.Interrupt)
-		<-chExit
+// initConfigFile creates the config file of the profile, values are given by flags or asked with -prompt
+func initConfigFile(args []string) int {
+	var options InitOptions
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Config file location")
+	flags.StringVar(&options.Profile, "profile", "", "Config profile: "+strings.Join(initProfiles, ", ")+" (default "+initDefaults.Profile+")")
+	flags.StringVar(&options.Address, "address", "", "Listen address (default "+initDefaults.Address+")")
+	flags.StringVar(&options.UploadPath, "upload-path", "", "Upload path (default "+initDefaults.UploadPath+")")
+	flags.StringVar(&options.LokiURL, "loki-url", "", "Loki push URL (default "+initDefaults.LokiURL+")")
+	flags.StringVar(&options.S3Endpoint, "s3-endpoint", "", "S3 endpoint of the s3 profile (default "+initDefaults.S3Endpoint+")")
+	flags.StringVar(&options.S3Bucket, "s3-bucket", "", "S3 bucket of the s3 profile (default "+initDefaults.S3Bucket+")")
+	flags.StringVar(&options.TLSCertFile, "tls-cert", "", "Certificate file of the tls profile (default "+initDefaults.TLSCertFile+")")
+	flags.StringVar(&options.TLSKeyFile, "tls-key", "", "Key file of the tls profile (default "+initDefaults.TLSKeyFile+")")
+	flags.StringVar(&options.JWKSURL, "jwks-url", "", "JWKS URL of the multi-tenant profile (default "+initDefaults.JWKSURL+")")
+	flags.StringVar(&options.JWTIssuer, "issuer", "", "Token issuer of the multi-tenant profile (default "+initDefaults.JWTIssuer+")")
+	prompt := flags.Bool("prompt", false, "Ask the values not given by flags")
+	flags.Parse(args)
+
+	if *prompt {
+		if err := options.Prompt(os.Stdin, os.Stdout); err != nil {
+			fmt.Printf("Can't read the answer:\n%v\n", err)
+			return 1
+		}
+	}
+	generated, warnings, err := GenerateConfig(*configFile, options)
+	if err != nil {
+		fmt.Printf("Can't create config file %s :\n%v\n", *configFile, err)
+		return 1
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "[WARN] %v\n", warning)
+	}
+	if !writeInitConfig(*configFile, generated) {
+		return 1
+	}
+	return 0
+}
+
+// writeInitConfig writes the config file unless it exists
+func writeInitConfig(configFile string, content []byte) bool {
+	if _, err := os.Stat(configFile); !os.IsNotExist(err) {
+		fmt.Printf("Config file %s already exists.\n", configFile)
+		return false
+	}
+	if err := os.WriteFile(configFile, content, 0644); err != nil {
+		fmt.Printf("Can't create config file %s :\n%v", configFile, err)
+		return false
+	}
+	fmt.Printf("Config file %s successfully created.\n", configFile)
+	return true
+}
+
+// configSchema prints or writes the JSON Schema of the config file
+func configSchema(args []string) int {
+	flags := flag.NewFlagSet("config-schema", flag.ExitOnError)
+	outFile := flags.String("out", "", "JSON Schema file location, printed when empty")
+	flags.Parse(args)
+
+	payload, _ := json.MarshalIndent(ConfigJSONSchema(), "", "  ")
+	payload = append(payload, '\n')
+	if *outFile == "" {
+		os.Stdout.Write(payload)
+		return 0
+	}
+	if err := os.WriteFile(*outFile, payload, 0644); err != nil {
+		fmt.Printf("Can't write JSON Schema %s :\n%v\n", *outFile, err)
+		return 1
 	}
+	fmt.Printf("JSON Schema %s successfully created.\n", *outFile)
+	return 0
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEndpointMetrics = "/metrics"
+
+// Buckets of push latency (seconds) and of device timestamp lag behind receipt time (seconds)
+var (
+	pushDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	lineLagBuckets      = []float64{1, 10, 60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600}
+)
+
+// Metrics of the ingestion pipeline, exposed in Prometheus text format
+var metrics = struct {
+	uploads        *counterVec
+	uploadBytes    *counterVec
+	archiveEntries *counterVec
+	linesParsed    *counterVec
+	linesPushed    *counterVec
+	linesSpooled   *counterVec
+	linesRejected  *counterVec
+	linesSkipped   *counterVec
+	pushes         *counterVec
+	pushDuration   *histogramVec
+	pushRetries    *counterVec
+	lineLag        *histogramVec
+	authFailures   *counterVec
+	rateLimited    *counterVec
+	quotaBytes     *counterVec
+	quotaLines     *counterVec
+}{
+	uploads:        newCounterVec("molog_uploads_total", "Uploads by endpoint and response status.", "endpoint", "status"),
+	uploadBytes:    newCounterVec("molog_upload_bytes_total", "Bytes of uploaded archives.", "endpoint"),
+	archiveEntries: newCounterVec("molog_archive_entries_total", "Archive entries processed.", "endpoint"),
+	linesParsed:    newCounterVec("molog_lines_parsed_total", "Log lines parsed.", "endpoint"),
+	linesPushed:    newCounterVec("molog_lines_pushed_total", "Log lines pushed to promtail.", "endpoint"),
+	linesSpooled:   newCounterVec("molog_lines_spooled_total", "Log lines spooled because promtail didn't accept them.", "endpoint"),
+	linesRejected:  newCounterVec("molog_lines_rejected_total", "Log lines rejected by reason.", "endpoint", "reason"),
+	linesSkipped:   newCounterVec("molog_lines_skipped_total", "Duplicate log lines skipped by reason.", "endpoint", "reason"),
+	pushes:         newCounterVec("molog_promtail_pushes_total", "Pushes to promtail by response status code.", "code"),
+	pushDuration:   newHistogramVec("molog_promtail_push_duration_seconds", "Latency of pushes to promtail.", pushDurationBuckets),
+	pushRetries:    newCounterVec("molog_promtail_push_retries_total", "Spooled pushes retried."),
+	lineLag:        newHistogramVec("molog_line_lag_seconds", "Lag of device log timestamps behind receipt time.", lineLagBuckets, "endpoint"),
+	authFailures:   newCounterVec("molog_auth_failures_total", "Failed authentication attempts by reason.", "endpoint", "reason"),
+	rateLimited:    newCounterVec("molog_rate_limited_total", "Uploads rejected by rate limits and quotas by reason.", "endpoint", "reason"),
+	quotaBytes:     newCounterVec("molog_quota_bytes_total", "Uploaded bytes counted against quotas.", "endpoint"),
+	quotaLines:     newCounterVec("molog_quota_lines_total", "Ingested lines counted against quotas.", "endpoint"),
+}
+
+// metricsCollectors order of metrics in the output
+func metricsCollectors() []metricsCollector {
+	return []metricsCollector{
+		metrics.uploads,
+		metrics.uploadBytes,
+		metrics.archiveEntries,
+		metrics.linesParsed,
+		metrics.linesPushed,
+		metrics.linesSpooled,
+		metrics.linesRejected,
+		metrics.linesSkipped,
+		metrics.pushes,
+		metrics.pushDuration,
+		metrics.pushRetries,
+		metrics.lineLag,
+		metrics.authFailures,
+		metrics.rateLimited,
+		metrics.quotaBytes,
+		metrics.quotaLines,
+	}
+}
+
+type metricsCollector interface {
+	write(writer *bufio.Writer)
+}
+
+// metricsKey joins label values into the map key
+func metricsKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func formatLabels(labelNames []string, labelValues []string, extra ...string) string {
+	if len(labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labelNames)+len(extra)/2)
+	for i, name := range labelNames {
+		pairs = append(pairs, name+"=\""+escapeLabelValue(labelValues[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabelValue(extra[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]*counterValue),
+	}
+}
+
+// Add increases the counter of the label values
+func (counter *counterVec) Add(delta float64, labelValues ...string) {
+	if delta == 0 {
+		return
+	}
+	key := metricsKey(labelValues)
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	value, exists := counter.values[key]
+	if !exists {
+		value = &counterValue{labelValues: labelValues}
+		counter.values[key] = value
+	}
+	value.value += delta
+}
+
+func (counter *counterVec) write(writer *bufio.Writer) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := counter.values[key]
+		fmt.Fprintf(writer, "%s%s %s\n", counter.name, formatLabels(counter.labelNames, value.labelValues), formatFloat(value.value))
+	}
+}
+
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*histogramValue),
+	}
+}
+
+// Observe adds the observation for the label values
+func (histogram *histogramVec) Observe(observation float64, labelValues ...string) {
+	key := metricsKey(labelValues)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	value, exists := histogram.values[key]
+	if !exists {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = value
+	}
+	for i, bound := range histogram.buckets {
+		if observation <= bound {
+			value.counts[i]++
+		}
+	}
+	value.sum += observation
+	value.count++
+}
+
+func (histogram *histogramVec) write(writer *bufio.Writer) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := histogram.values[key]
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labelNames, value.labelValues, "le", formatFloat(bound)), value.counts[i])
+		}
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labelNames, value.labelValues, "le", "+Inf"), value.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", histogram.name, formatLabels(histogram.labelNames, value.labelValues), formatFloat(value.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labelNames, value.labelValues), value.count)
+	}
+}
+
+func writeGauge(writer *bufio.Writer, name string, help string, value float64) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+// serveMetrics writes metrics in Prometheus text format
+func (moLog *MoLog) serveMetrics(responseWriter http.ResponseWriter, request *http.Request) {
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer := bufio.NewWriter(responseWriter)
+	defer writer.Flush()
+	for _, collector := range metricsCollectors() {
+		collector.write(writer)
+	}
+	if moLog.Spool != nil {
+		writeGauge(writer, "molog_spool_depth", "Pushes waiting in the spool.", float64(moLog.Spool.Depth()))
+		writeGauge(writer, "molog_spool_bytes", "Size of the spool.", float64(moLog.Spool.Size()))
+	}
+}
+
+// statusRecorder remembers the response status for metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// observePush records latency and status code of a push to promtail, code 0 is a transport error
+func observePush(started time.Time, statusCode int) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	metrics.pushes.Add(1, code)
+	metrics.pushDuration.Observe(time.Since(started).Seconds())
+}
@@ -1,47 +1,69 @@
 package main
 
 import (
-	"archive/zip"
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
-	escape "main/utils"
-	"maps"
+	escape "molog/utils"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // MoLog Promtail to endpoint config
 type MoLog struct {
 	Address       string
-	TLSCertFile   string
-	TLSKeyFile    string
+	TLS           *ListenerTLS
 	SourceFile    string
+	ConfigFiles   []string
 	Promtails     map[string]*MoLogPromtail
 	TestUIs       map[string]*string
 	MaxUploadSize int64
+	Idempotency   *IdempotencyStore
+	Devices       *DeviceDedup
+	Spool         *Spool
+	S3s           []*MoLogS3
+
+	// X-Forwarded-For of these peers gives the client address
+	TrustedProxies []*net.IPNet
+
+	EndpointHealth  string
+	EndpointReady   string
+	EndpointMetrics string
+
+	ShutdownTimeout time.Duration
+	drain           context.Context
 }
 
-// MoLogPromtail Redis config
+// MoLogPromtail upload endpoint with its sink, parser and client limits
 type MoLogPromtail struct {
-	PromtailClientConfig map[string]interface{}
+	Sink            ConfigLokiSink
+	FilenamePattern *regexp.Regexp
+	ArchiveLimits   ArchiveLimits
+	DeviceDedup     bool
+	DedupWindow     int
+	ArchiveDedup    bool
+	ArchiveEntries  []string
+	Labels          []EndpointLabel
+	QueryParams     []*QueryParam
+	APIKeys         []*APIKey
+	APIKeyHeader    string
+	APIKeyQuery     string
+	SignedURLSecret []byte
+	JWT             *JWTValidator
+	RateLimit       *RateLimit
 }
 
 type TemplateInfo struct {
 	TestPath, WSURL string
 }
 
-type SuccessfullyUploadedResult struct {
-	OK   bool   `json:"ok"`
-	Path string `json:"path"`
-}
-
 var localStatic = false
 var testTemplate *template.Template
 var rexStatic = regexp.MustCompile(`(.*)(/static/.+(\.[a-z0-9]+))$`)
@@ -68,15 +90,10 @@ var mimeTypes = map[string]string{
 // 	return val
 // }
 
-// Start start websocket and start consuming from Redis stream(s)
-func (moLog *MoLog) Start() error {
-	if moLog.TLSCertFile != "" {
-		return http.ListenAndServeTLS(moLog.Address, moLog.TLSCertFile, moLog.TLSKeyFile, moLog)
-	}
-	return http.ListenAndServe(moLog.Address, moLog)
-}
-
 func (moLog *MoLog) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if len(moLog.TrustedProxies) > 0 {
+		request.RemoteAddr = forwardedClient(request, moLog.TrustedProxies)
+	}
 	subMatch := rexStatic.FindStringSubmatch(request.URL.Path)
 	if len(subMatch) > 0 {
 		// serve static files
@@ -100,7 +117,7 @@ func (moLog *MoLog) ServeHTTP(responseWriter http.ResponseWriter, request *http.
 		html, err := FSString(localStatic, "/static/test.html")
 		if err == nil {
 			uploadURL := "http://" + request.Host + *uploadPath
-			if moLog.TLSCertFile != "" {
+			if moLog.TLS != nil {
 				uploadURL = "https://" + request.Host + *uploadPath
 			}
 			if testTemplate == nil || localStatic {
@@ -110,168 +127,99 @@ func (moLog *MoLog) ServeHTTP(responseWriter http.ResponseWriter, request *http.
 		}
 		return
 	} else if promtailConfig, exists := moLog.Promtails[request.URL.Path]; exists {
-		// TODO: check method (only PUT and POST allowed)
-		// Upload file
-		uploadedFile, uploadedFileInfo, err := request.FormFile("file")
-		if err != nil {
-			log.Printf("[ERROR] Failed to obtain form file: %v", err)
-			return // http.StatusInternalServerError, "", fmt.Errorf("cannot obtain the uploaded content")
-		}
-		uploadFileReadeCloser := http.MaxBytesReader(responseWriter, uploadedFile, moLog.MaxUploadSize)
-		// MaxBytesReader closes the underlying io.Reader on its Close() is called
-		defer uploadFileReadeCloser.Close()
-
-		// Construct path for push API (keywords for search: grafana.com promtail-push-api plaintext payload)
-		baseStreams := make(map[string]*string)
-		// Read basic label, value pairs from query string
-		for label, values := range request.URL.Query() {
-			for _, value := range values {
-				baseStreams[label] = &value
-			}
-		}
-		filename := uploadedFileInfo.Filename // Additional label
-		log.Printf("Filename is %v", filename)
-		timestampDate := time.Now().Format(time.DateOnly)
-		if filename != "" {
-			fileDate := strings.Split(filename[0:8], ".")
-			timestampDate = fmt.Sprintf("20%v-%v-%v", fileDate[2], fileDate[0], fileDate[1])
-		}
-
-		// Read and unzip file
-		zipReader, err := zip.NewReader(uploadedFile, uploadedFileInfo.Size)
-		if err != nil {
-			log.Printf("[ERROR] Error read archive file %v (error: %v)", filename, err)
-			return
-		}
-		for _, packedFile := range zipReader.File {
-			if strings.HasSuffix(packedFile.Name, "Verbose.log") {
-				packedFileReadCloser, err := packedFile.Open()
-				if err != nil {
-					log.Printf("[ERROR] Error unpacked file %v from archive %v (error: %v)", packedFile, filename, err)
-					return
-				}
-				defer packedFileReadCloser.Close()
-				packedFileScanner := bufio.NewScanner(packedFileReadCloser)
-				packedFileScanner.Split(bufio.ScanLines)
-				for packedFileScanner.Scan() {
-					rawPushPayload := packedFileScanner.Text()
-
-					// Line sample for custom format
-					// 00:09:58:096__FINE_____TAG_AuthManag            |﹏AuthManag <--
-					timestampTimeComponents := strings.Split(rawPushPayload[0:12], ":")
-					timestampTime := fmt.Sprintf(
-						"%v:%v:%v.%v",
-						timestampTimeComponents[0],
-						timestampTimeComponents[1],
-						timestampTimeComponents[2],
-						timestampTimeComponents[3],
-					)
-					logLevel := strings.ReplaceAll(rawPushPayload[14:23], "_", "")
-					logSource := strings.ReplaceAll(rawPushPayload[23:48], " ", "")
-					_, logTag, logSourceIsTag := strings.Cut(logSource, "_")
-
-					// Push to promtail
-					streams := maps.Clone(baseStreams)
-					streams["level"] = &logLevel
-					if logSourceIsTag {
-						streams["tag"] = &logTag
-					} else {
-						streams["source"] = &logSource
-					}
-
-					// Parse time value
-					timestampText := fmt.Sprintf("%vT%v000000+03:00", timestampDate, timestampTime)
-					timestamp, err := time.Parse(time.RFC3339Nano, timestampText)
-					if err != nil {
-						log.Printf("[ERROR] Failed parse timestamp %v: %v", timestampText, err)
-						return
-					}
-
-					// Make post request to promtail
-					promtailRequest, err := makePromtailRequest(
-						streams,
-						timestamp,
-						rawPushPayload,
-						promtailConfig,
-					)
-					if err != nil {
-						log.Printf("[ERROR] Failed make request: %v", err)
-						return
-					}
-
-					promtailResponse, err := http.DefaultClient.Do(promtailRequest)
-					if err != nil {
-						log.Printf("[ERROR] Failed to POST: %v", err)
-						return
-					}
-					defer promtailResponse.Body.Close()
-					if promtailResponse.StatusCode != http.StatusNoContent {
-						log.Printf("[INFO] status = %d, want = %d", promtailResponse.StatusCode, http.StatusNoContent)
-						if ct := promtailResponse.Header.Get("Content-Type"); ct != "application/json" {
-							log.Printf("Content-Type = %s, want = \"application/json\"", ct)
-							result_body, err := io.ReadAll(promtailResponse.Body)
-							if err != nil {
-								log.Printf("[ERROR] Failed to read response body: %v", err)
-								return
-							}
-							log.Printf("[INFO] Push result %v", string(result_body[:]))
-						} else {
-							body, err := io.ReadAll(promtailResponse.Body)
-							if err != nil {
-								log.Printf("[ERROR] Failed to read response body: %v", err)
-								return
-							}
-							var result SuccessfullyUploadedResult
-							if err := json.Unmarshal(body, &result); err != nil {
-								log.Printf("[ERROR] Failed to decode response body: %v", err)
-								return
-							}
-							log.Printf("[INFO] Push result as json %v", result)
-						}
-					}
-				}
-			}
-		}
+		recorder := &statusRecorder{ResponseWriter: responseWriter, status: http.StatusOK}
+		moLog.serveUpload(recorder, request, promtailConfig)
+		metrics.uploads.Add(1, request.URL.Path, strconv.Itoa(recorder.status))
+		return
+	} else if request.URL.Path == moLog.EndpointHealth {
+		moLog.serveHealth(responseWriter, request)
+		return
+	} else if request.URL.Path == moLog.EndpointReady {
+		moLog.serveReady(responseWriter, request)
+		return
+	} else if request.URL.Path == moLog.EndpointMetrics {
+		moLog.serveMetrics(responseWriter, request)
 		return
 	}
 	responseWriter.WriteHeader(404)
 }
 
-func makePromtailRequest(streams map[string]*string, timestamp time.Time, payload string, promtailConfig *MoLogPromtail) (*http.Request, error) {
-	requestBodyBuffer := new(bytes.Buffer)
-	requestBodyBuffer.WriteString("{\"streams\":[{\"stream\":{")
-	lastLabel := len(streams)
-	for label, value := range streams {
-		requestBodyBuffer.WriteString("\"")
-		requestBodyBuffer.WriteString(label)
-		requestBodyBuffer.WriteString("\":\"")
-		requestBodyBuffer.WriteString(*value)
-		requestBodyBuffer.WriteString("\"")
-		lastLabel -= 1
-		if lastLabel > 0 {
-			requestBodyBuffer.WriteString(",")
-		}
-	}
-	requestBodyBuffer.WriteString("},\"values\":[[\"")                                           // TODO: put batch into the request
-	requestBodyBuffer.WriteString(fmt.Sprintf("%v%v", timestamp.Unix(), timestamp.Nanosecond())) // TODO: add lead zero to the nanoseconds
-	requestBodyBuffer.WriteString("\",")
-	requestBodyBuffer.WriteString(escape.JSON(payload))
-	requestBodyBuffer.WriteString("]]}]}")
-
-	if promtailConfig.PromtailClientConfig["url"] == nil {
+func makePromtailRequest(streams map[string]*string, timestamp time.Time, payload string, metadata map[string]string, promtailConfig *MoLogPromtail) (*http.Request, error) {
+	if promtailConfig.Sink.URL == "" {
 		return nil, fmt.Errorf("EMPTY promtail url settings")
 	}
 
-	// TODO: remove debug line fmt.Printf("BODY is %v\n", requestBodyBuffer.String())
+	// names and values may come from the client, the writer sanitises and escapes them
+	pushWriter := escape.NewPushWriter()
+	for label, value := range streams {
+		pushWriter.Label(label, *value)
+	}
+	pushWriter.Value(timestamp, payload, metadata) // TODO: put batch into the request
+	push := &pushBuffer{writer: pushWriter}
 
 	req, err := http.NewRequest(
 		"POST",
-		fmt.Sprintf("%v", promtailConfig.PromtailClientConfig["url"]),
-		requestBodyBuffer,
+		promtailConfig.Sink.URL,
+		&pushBody{push: push},
 	)
 	if err != nil {
+		push.release()
 		return nil, err
 	}
+	req.ContentLength = int64(len(pushWriter.Bytes()))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return &pushBody{push: push}, nil
+	}
 	req.Header.Set("Content-Type", "application/json") // TODO: use reference for mime type
 	return req, nil
 }
+
+// pushBuffer pooled push body of a promtail request, shared by the readers of the request body
+type pushBuffer struct {
+	mu     sync.Mutex
+	writer *escape.PushWriter
+}
+
+// pushBody reader of the push body. The transport may still read the body after the response
+// (e.g. promtail answered early), once released such reads fail instead of seeing a reused buffer.
+type pushBody struct {
+	push   *pushBuffer
+	offset int
+}
+
+var errPushBodyReleased = errors.New("push body is released")
+
+func (body *pushBody) Read(p []byte) (int, error) {
+	body.push.mu.Lock()
+	defer body.push.mu.Unlock()
+	if body.push.writer == nil {
+		return 0, errPushBodyReleased
+	}
+	remaining := body.push.writer.Bytes()[body.offset:]
+	if len(remaining) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, remaining)
+	body.offset += n
+	return n, nil
+}
+
+func (body *pushBody) Close() error {
+	return nil
+}
+
+func (push *pushBuffer) release() {
+	push.mu.Lock()
+	defer push.mu.Unlock()
+	if push.writer != nil {
+		push.writer.Release()
+		push.writer = nil
+	}
+}
+
+// releasePromtailRequest returns the body of the request to the pool once the line is pushed or spooled
+func releasePromtailRequest(promtailRequest *http.Request) {
+	if body, ok := promtailRequest.Body.(*pushBody); ok {
+		body.push.release()
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// BenchmarkMakePromtailRequest push request of one line, the body is read as the HTTP client does
+func BenchmarkMakePromtailRequest(b *testing.B) {
+	promtailConfig := &MoLogPromtail{Sink: ConfigLokiSink{URL: "http://127.0.0.1:3500/loki/api/v1/push"}}
+	streams := make(map[string]*string)
+	for _, label := range [][2]string{{"env", "prod"}, {"app", "field-service"}, {"device", "d1"}, {"level", "FINE"}, {"source", "SplitLogger"}} {
+		value := label[1]
+		streams[label[0]] = &value
+	}
+	metadata := map[string]string{"session": "s1"}
+	line := `00:09:58:068__FINE_____SplitLogger              |***File handlers initialized "quoted" path\to`
+	timestamp := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		request, err := makePromtailRequest(streams, timestamp, line, metadata, promtailConfig)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, request.Body)
+		request.Body.Close()
+	}
+}
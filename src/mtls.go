@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	escape "molog/utils"
+)
+
+// Sources of client certificate labels, any other source is the OID of a certificate extension
+const (
+	clientCertCN       = "cn"
+	clientCertSANDNS   = "san.dns"
+	clientCertSANEmail = "san.email"
+	clientCertSANURI   = "san.uri"
+	clientCertSANIP    = "san.ip"
+)
+
+var errClientCertificate = errors.New("client certificate")
+
+// ClientTLS client authentication of the listener by certificates of the client CA
+type ClientTLS struct {
+	CAs    *x509.CertPool
+	Auth   tls.ClientAuthType
+	Labels map[string]string
+}
+
+// NewClientTLS loads the client CA bundle, auth is require (default) or optional
+func NewClientTLS(caFile string, auth string, labels map[string]string) (*ClientTLS, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	clientTLS := &ClientTLS{
+		CAs:    x509.NewCertPool(),
+		Labels: labels,
+	}
+	if !clientTLS.CAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	switch auth {
+	case "", "require":
+		clientTLS.Auth = tls.RequireAndVerifyClientCert
+	case "optional":
+		clientTLS.Auth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("client.auth must be require or optional, not [%s]", auth)
+	}
+	if err := checkLabelNames(labels); err != nil {
+		return nil, fmt.Errorf("client.labels: %v", err)
+	}
+	for label, source := range labels {
+		switch source {
+		case clientCertCN, clientCertSANDNS, clientCertSANEmail, clientCertSANURI, clientCertSANIP:
+		default:
+			if _, err := parseOID(source); err != nil {
+				return nil, fmt.Errorf("unknown source [%s] of label [%s]", source, label)
+			}
+		}
+	}
+	return clientTLS, nil
+}
+
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %s", value)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		if _, err := fmt.Sscanf(part, "%d", &oid[i]); err != nil || oid[i] < 0 {
+			return nil, fmt.Errorf("invalid OID %s", value)
+		}
+	}
+	return oid, nil
+}
+
+// certificateValue value of the source in the certificate, first one of several SANs
+func certificateValue(certificate *x509.Certificate, source string) string {
+	switch source {
+	case clientCertCN:
+		return certificate.Subject.CommonName
+	case clientCertSANDNS:
+		if len(certificate.DNSNames) > 0 {
+			return certificate.DNSNames[0]
+		}
+	case clientCertSANEmail:
+		if len(certificate.EmailAddresses) > 0 {
+			return certificate.EmailAddresses[0]
+		}
+	case clientCertSANURI:
+		if len(certificate.URIs) > 0 {
+			return certificate.URIs[0].String()
+		}
+	case clientCertSANIP:
+		if len(certificate.IPAddresses) > 0 {
+			return certificate.IPAddresses[0].String()
+		}
+	default:
+		oid, _ := parseOID(source)
+		for _, extension := range certificate.Extensions {
+			if extension.Id.Equal(oid) {
+				// string extensions are decoded, anything else is passed as hex of DER
+				var value string
+				if _, err := asn1.Unmarshal(extension.Value, &value); err == nil {
+					return value
+				}
+				return hex.EncodeToString(extension.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// authenticate adds labels of the verified client certificate to the principal,
+// a configured label missing in the certificate fails the request so the client can't set it by query.
+// Without certificate (client.auth optional) query parameters of the labels are dropped.
+func (clientTLS *ClientTLS) authenticate(request *http.Request, principal *Principal) (*Principal, error) {
+	if clientTLS == nil {
+		return principal, nil
+	}
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		clientTLS.dropQueryLabels(request)
+		return principal, nil
+	}
+	certificate := request.TLS.VerifiedChains[0][0]
+	if principal == nil {
+		principal = &Principal{Name: certificate.Subject.CommonName}
+	}
+	if len(clientTLS.Labels) == 0 {
+		return principal, nil
+	}
+	labels := make(map[string]string, len(principal.Labels)+len(clientTLS.Labels))
+	for label, value := range principal.Labels {
+		labels[label] = value
+	}
+	for label, source := range clientTLS.Labels {
+		value := certificateValue(certificate, source)
+		if value == "" {
+			return nil, fmt.Errorf("%w of %s has no %s for label %s", errClientCertificate, certificate.Subject.CommonName, source, label)
+		}
+		labels[label] = value
+	}
+	principal.Labels = labels
+	return principal, nil
+}
+
+// dropQueryLabels removes query parameters that would set labels of the certificate,
+// names are compared sanitised like labels of the query are set
+func (clientTLS *ClientTLS) dropQueryLabels(request *http.Request) {
+	if len(clientTLS.Labels) == 0 {
+		return
+	}
+	query := request.URL.Query()
+	dropped := false
+	for name := range query {
+		if _, exists := clientTLS.Labels[escape.LabelName(name)]; exists {
+			log.Printf("[WARN] Query parameter %v of %v without client certificate is dropped", name, clientIP(request))
+			query.Del(name)
+			dropped = true
+		}
+	}
+	if dropped {
+		request.URL.RawQuery = query.Encode()
+	}
+}
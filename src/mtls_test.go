@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestClientTLS() *ClientTLS {
+	return &ClientTLS{
+		Auth:   tls.VerifyClientCertIfGiven,
+		Labels: map[string]string{"device_id": clientCertCN},
+	}
+}
+
+func TestClientTLSWithoutCertificateDropsQueryLabels(t *testing.T) {
+	clientTLS := newTestClientTLS()
+	for _, query := range []string{"device_id=victim&app=crm", "device-id=victim&app=crm", "device_id=a&device_id=b&app=crm"} {
+		request := httptest.NewRequest("POST", "https://molog/upload?"+query, nil)
+		request.TLS = &tls.ConnectionState{}
+		principal, err := clientTLS.authenticate(request, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if principal != nil {
+			t.Fatalf("%s: principal %+v without certificate", query, principal)
+		}
+		if got := request.URL.RawQuery; got != "app=crm" {
+			t.Fatalf("%s: query %q, want app=crm", query, got)
+		}
+	}
+}
+
+func TestClientTLSCertificateLabels(t *testing.T) {
+	clientTLS := newTestClientTLS()
+	request := httptest.NewRequest("POST", "https://molog/upload?device_id=victim", nil)
+	request.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "device-1"}}}},
+	}
+	principal, err := clientTLS.authenticate(request, &Principal{Name: "key", Labels: map[string]string{"app": "crm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Labels["device_id"] != "device-1" || principal.Labels["app"] != "crm" {
+		t.Fatalf("labels %v", principal.Labels)
+	}
+
+	clientTLS.Labels["serial"] = clientCertSANDNS
+	if _, err := clientTLS.authenticate(request, nil); !errors.Is(err, errClientCertificate) {
+		t.Fatalf("certificate without SAN DNS: %v", err)
+	}
+}
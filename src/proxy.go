@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+// parseTrustedProxies networks of the proxies (CIDR or address) whose X-Forwarded-For is trusted
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address or CIDR [%s]", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR [%s]", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func trustedProxy(ip net.IP, proxies []*net.IPNet) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient address of the client of a request forwarded by trusted proxies: the last address of
+// X-Forwarded-For that isn't a trusted proxy. Requests of other peers keep their remote address, their
+// X-Forwarded-For may be forged.
+func forwardedClient(request *http.Request, proxies []*net.IPNet) string {
+	peer := net.ParseIP(clientIP(request))
+	if peer == nil || !trustedProxy(peer, proxies) {
+		return request.RemoteAddr
+	}
+	var hops []string
+	for _, header := range request.Header.Values(forwardedForHeader) {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !trustedProxy(ip, proxies) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Targets of query parameters
+const (
+	queryTargetLabel    = "label"
+	queryTargetMetadata = "metadata"
+	queryTargetDrop     = "drop"
+)
+
+// ConfigQueryParam accepted query parameter of the upload endpoint
+type ConfigQueryParam struct {
+	Name     string   `yaml:"name"`
+	Required bool     `yaml:"required,omitempty"`
+	Pattern  string   `yaml:"pattern,omitempty"`
+	Enum     []string `yaml:"enum,omitempty"`
+	Target   string   `yaml:"target,omitempty"`
+}
+
+// QueryParam compiled query parameter, the pattern matches the whole value
+type QueryParam struct {
+	Name     string
+	Required bool
+	Pattern  *regexp.Regexp
+	Enum     []string
+	Target   string
+}
+
+// UploadQuery values of the query parameters by target
+type UploadQuery struct {
+	Labels   map[string]string
+	Metadata map[string]string
+}
+
+// NewQueryParam validates the query parameter config, label is the default target
+func NewQueryParam(paramConfig ConfigQueryParam) (*QueryParam, error) {
+	param := &QueryParam{
+		Name:     paramConfig.Name,
+		Required: paramConfig.Required,
+		Enum:     paramConfig.Enum,
+		Target:   paramConfig.Target,
+	}
+	if param.Target == "" {
+		param.Target = queryTargetLabel
+	}
+	switch param.Target {
+	case queryTargetLabel, queryTargetMetadata:
+		// the parameter name is the name of the label or metadata
+		if !rexLabelName.MatchString(param.Name) || strings.HasPrefix(param.Name, "__") {
+			return nil, fmt.Errorf("invalid %s name [%s]", param.Target, param.Name)
+		}
+		if param.Target == queryTargetLabel && contains(lineLabels, param.Name) {
+			return nil, fmt.Errorf("label [%s] is set per line, use target metadata or drop", param.Name)
+		}
+	case queryTargetDrop:
+		if param.Name == "" {
+			return nil, fmt.Errorf("name must be defined")
+		}
+	default:
+		return nil, fmt.Errorf("target must be %s, %s or %s, not [%s]", queryTargetLabel, queryTargetMetadata, queryTargetDrop, param.Target)
+	}
+	if paramConfig.Pattern != "" {
+		pattern, err := regexp.Compile(`^(?:` + paramConfig.Pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %v", err)
+		}
+		param.Pattern = pattern
+	}
+	return param, nil
+}
+
+// parseQuery checks the query parameters of the upload against the schema of the endpoint.
+// Without schema every parameter is a label, with schema unknown, missing required and invalid values
+// are rejected with 400.
+func (promtailConfig *MoLogPromtail) parseQuery(query url.Values) (*UploadQuery, error) {
+	uploadQuery := &UploadQuery{Labels: make(map[string]string), Metadata: make(map[string]string)}
+	if len(promtailConfig.QueryParams) == 0 {
+		// names are sanitised when the labels are set
+		for name, values := range query {
+			uploadQuery.Labels[name] = values[len(values)-1]
+		}
+		return uploadQuery, nil
+	}
+	params := make(map[string]*QueryParam, len(promtailConfig.QueryParams))
+	for _, param := range promtailConfig.QueryParams {
+		params[param.Name] = param
+	}
+	var problems []string
+	for name := range query {
+		if _, exists := params[name]; !exists {
+			problems = append(problems, fmt.Sprintf("unknown query parameter [%s]", name))
+		}
+	}
+	sort.Strings(problems)
+	for _, param := range promtailConfig.QueryParams {
+		values, exists := query[param.Name]
+		if !exists || values[len(values)-1] == "" {
+			if param.Required {
+				problems = append(problems, fmt.Sprintf("query parameter [%s] is required", param.Name))
+			}
+			continue
+		}
+		value := values[len(values)-1]
+		if param.Pattern != nil && !param.Pattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("query parameter [%s] doesn't match the pattern", param.Name))
+			continue
+		}
+		if len(param.Enum) > 0 && !contains(param.Enum, value) {
+			problems = append(problems, fmt.Sprintf("query parameter [%s] must be one of %s", param.Name, strings.Join(param.Enum, ", ")))
+			continue
+		}
+		switch param.Target {
+		case queryTargetLabel:
+			uploadQuery.Labels[param.Name] = value
+		case queryTargetMetadata:
+			uploadQuery.Metadata[param.Name] = value
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &StatusError{Status: http.StatusBadRequest, Err: fmt.Errorf("%s", strings.Join(problems, ", "))}
+	}
+	return uploadQuery, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewQueryParam(t *testing.T) {
+	for _, test := range []struct {
+		config ConfigQueryParam
+		err    string
+	}{
+		{ConfigQueryParam{Name: "device_id", Pattern: "[a-z0-9-]+"}, ""},
+		{ConfigQueryParam{Name: "app-id", Target: queryTargetDrop}, ""},
+		{ConfigQueryParam{Name: "app-id"}, "invalid label name [app-id]"},
+		{ConfigQueryParam{Name: "1st"}, "invalid label name [1st]"},
+		{ConfigQueryParam{Name: "__name__"}, "invalid label name [__name__]"},
+		{ConfigQueryParam{Name: "session id", Target: queryTargetMetadata}, "invalid metadata name [session id]"},
+		{ConfigQueryParam{Name: "level"}, "label [level] is set per line, use target metadata or drop"},
+		{ConfigQueryParam{Name: "", Target: queryTargetDrop}, "name must be defined"},
+		{ConfigQueryParam{Name: "app", Target: "header"}, "target must be label, metadata or drop, not [header]"},
+		{ConfigQueryParam{Name: "app", Pattern: "("}, "invalid pattern"},
+	} {
+		_, err := NewQueryParam(test.config)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: error %v, want %q", test.config, err, test.err)
+		}
+	}
+}
+
+func newTestQueryPromtail(t *testing.T, paramConfigs ...ConfigQueryParam) *MoLogPromtail {
+	promtailConfig := &MoLogPromtail{}
+	for _, paramConfig := range paramConfigs {
+		param, err := NewQueryParam(paramConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		promtailConfig.QueryParams = append(promtailConfig.QueryParams, param)
+	}
+	return promtailConfig
+}
+
+func TestParseQuery(t *testing.T) {
+	promtailConfig := newTestQueryPromtail(t,
+		ConfigQueryParam{Name: "device_id", Required: true, Pattern: "[a-z0-9-]{1,32}"},
+		ConfigQueryParam{Name: "env", Enum: []string{"prod", "test"}},
+		ConfigQueryParam{Name: "session", Target: queryTargetMetadata},
+		ConfigQueryParam{Name: "token", Target: queryTargetDrop},
+	)
+	for _, test := range []struct {
+		query    string
+		labels   map[string]string
+		metadata map[string]string
+		err      string
+	}{
+		{query: "device_id=d-1&env=prod&session=s1&token=x",
+			labels: map[string]string{"device_id": "d-1", "env": "prod"}, metadata: map[string]string{"session": "s1"}},
+		{query: "device_id=d-1&device_id=d-2", labels: map[string]string{"device_id": "d-2"}, metadata: map[string]string{}},
+		{query: "env=prod", err: "query parameter [device_id] is required"},
+		{query: "device_id=", err: "query parameter [device_id] is required"},
+		{query: "device_id=D%221%22", err: "query parameter [device_id] doesn't match the pattern"},
+		{query: "device_id=d-1&env=dev", err: "query parameter [env] must be one of prod, test"},
+		{query: "device_id=d-1&app-id=crm&Level=x", err: "unknown query parameter [Level], unknown query parameter [app-id]"},
+	} {
+		query, _ := url.ParseQuery(test.query)
+		uploadQuery, err := promtailConfig.parseQuery(query)
+		if test.err != "" {
+			var statusError *StatusError
+			if !errors.As(err, &statusError) || statusError.Status != http.StatusBadRequest || statusError.Err.Error() != test.err {
+				t.Errorf("%s: error %v, want 400 %s", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(uploadQuery.Labels, test.labels) || !reflect.DeepEqual(uploadQuery.Metadata, test.metadata) {
+			t.Errorf("%s: labels %v metadata %v", test.query, uploadQuery.Labels, uploadQuery.Metadata)
+		}
+	}
+}
+
+func TestUploadRejectedQuery(t *testing.T) {
+	moLog := &MoLog{MaxUploadSize: 1 << 20}
+	promtailConfig := newTestQueryPromtail(t, ConfigQueryParam{Name: "device_id", Required: true, Pattern: "[a-z0-9-]+"})
+	recorder := httptest.NewRecorder()
+	moLog.serveUpload(recorder, httptest.NewRequest(http.MethodPost, "/upload?device_id=..%2Fetc", strings.NewReader("")), promtailConfig)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", recorder.Code)
+	}
+	var result UploadResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.OK || len(result.Errors) != 1 || result.Errors[0] != "query parameter [device_id] doesn't match the pattern" {
+		t.Fatalf("result %+v", result)
+	}
+}
+
+func TestCheckConfigQueryParams(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	content := `schema.version: "2.0"
+sinks:
+  loki:
+    - name: loki
+      url: http://promtail:3500/loki/api/v1/push
+listeners:
+  - address: :8804
+    endpoints:
+      - endpoint.upload: /upload
+        sink: loki
+        query.params:
+          - name: app-id
+          - name: level
+          - name: device_id
+            pattern: "("
+`
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var configErrors ConfigErrors
+	if err := CheckConfig(filename); !errors.As(err, &configErrors) {
+		t.Fatalf("error %v, want config errors", err)
+	}
+	var messages []string
+	for _, configError := range configErrors {
+		messages = append(messages, configError.Error())
+	}
+	for _, want := range []string{
+		"config.yaml:12:13: listeners[0].endpoints[0].query.params[0]: invalid label name [app-id]",
+		"config.yaml:13:13: listeners[0].endpoints[0].query.params[1]: label [level] is set per line, use target metadata or drop",
+		"config.yaml:14:13: listeners[0].endpoints[0].query.params[2]: invalid pattern",
+	} {
+		if !strings.Contains(strings.Join(messages, "\n"), want) {
+			t.Errorf("errors %q miss %q", messages, want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients are told apart by IP address unless rate.limit.key says otherwise
+const (
+	rateLimitKeyIP        = "ip"
+	rateLimitKeyPrincipal = "principal"
+	rateLimitKeyLabel     = "label:"
+)
+
+// Buckets refilled to the burst are forgotten once there are more than maxTokenBuckets
+const maxTokenBuckets = 10000
+
+// Daily usage is kept a bit longer than the day
+const quotaUsageTTL = 48 * time.Hour
+
+// Token buckets by endpoint, client key and limit, a reloaded config keeps taking from the ones in use
+var sharedTokenBuckets = struct {
+	mu      sync.Mutex
+	buckets map[string]*TokenBuckets
+}{buckets: make(map[string]*TokenBuckets)}
+
+// RateLimit request and byte rate limits and daily quotas of the upload endpoint, zero value means no limit
+type RateLimit struct {
+	Key        string
+	Requests   *TokenBuckets
+	Bytes      *TokenBuckets
+	DailyBytes int64
+	DailyLines int64
+	Quotas     *QuotaStore
+}
+
+// NewRateLimit rate limits of the endpoint config, nil when nothing is limited
+func NewRateLimit(endpointConfig ConfigEndpoint, quotas *QuotaStore) (*RateLimit, error) {
+	rateLimit := &RateLimit{
+		Key:        endpointConfig.RateLimitKey,
+		DailyBytes: endpointConfig.QuotaDailyBytes,
+		DailyLines: endpointConfig.QuotaDailyLines,
+		Quotas:     quotas,
+	}
+	switch {
+	case rateLimit.Key == "":
+		rateLimit.Key = rateLimitKeyIP
+	case rateLimit.Key == rateLimitKeyIP || rateLimit.Key == rateLimitKeyPrincipal:
+	case strings.HasPrefix(rateLimit.Key, rateLimitKeyLabel) && len(rateLimit.Key) > len(rateLimitKeyLabel):
+	default:
+		return nil, fmt.Errorf("rate.limit.key must be ip, principal or label:<name>, not [%s]", rateLimit.Key)
+	}
+	if endpointConfig.RateLimitRequests > 0 {
+		rateLimit.Requests = NewTokenBuckets(endpointConfig.RateLimitRequests, float64(endpointConfig.RateLimitRequestsBurst))
+	}
+	if endpointConfig.RateLimitBytes > 0 {
+		rateLimit.Bytes = NewTokenBuckets(float64(endpointConfig.RateLimitBytes), float64(endpointConfig.RateLimitBytesBurst))
+	}
+	if rateLimit.Requests == nil && rateLimit.Bytes == nil && rateLimit.DailyBytes <= 0 && rateLimit.DailyLines <= 0 {
+		return nil, nil
+	}
+	return rateLimit, nil
+}
+
+// share replaces the buckets by the ones of the running config, they take the rate and burst of the reloaded one
+func (rateLimit *RateLimit) share(endpoint string) {
+	rateLimit.Requests = shareTokenBuckets(endpoint+" "+rateLimit.Key+" requests", rateLimit.Requests)
+	rateLimit.Bytes = shareTokenBuckets(endpoint+" "+rateLimit.Key+" bytes", rateLimit.Bytes)
+}
+
+func shareTokenBuckets(key string, buckets *TokenBuckets) *TokenBuckets {
+	if buckets == nil {
+		return nil
+	}
+	sharedTokenBuckets.mu.Lock()
+	defer sharedTokenBuckets.mu.Unlock()
+	shared, exists := sharedTokenBuckets.buckets[key]
+	if !exists {
+		sharedTokenBuckets.buckets[key] = buckets
+		return buckets
+	}
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	shared.rate = buckets.rate
+	shared.burst = buckets.burst
+	return shared
+}
+
+// ClientKey the client the limits apply to. Labels are taken from the authenticated client only, the query is
+// up to the client and would give it a bucket per value. Falls back to the IP address when the label is missing.
+func (rateLimit *RateLimit) ClientKey(request *http.Request, principal *Principal) string {
+	switch {
+	case rateLimit.Key == rateLimitKeyPrincipal && principal != nil && principal.Name != "":
+		return principal.Name
+	case strings.HasPrefix(rateLimit.Key, rateLimitKeyLabel):
+		label := strings.TrimPrefix(rateLimit.Key, rateLimitKeyLabel)
+		if principal != nil && principal.Labels[label] != "" {
+			return principal.Labels[label]
+		}
+	}
+	return clientIP(request)
+}
+
+func tooManyRequests(wait time.Duration, format string, args ...interface{}) error {
+	return &StatusError{
+		Status:     http.StatusTooManyRequests,
+		Err:        fmt.Errorf(format, args...),
+		RetryAfter: strconv.FormatInt(int64(math.Ceil(max(wait.Seconds(), 1))), 10),
+	}
+}
+
+// Allow takes a request from the bucket of the client and checks daily quotas used up by earlier uploads,
+// the error is 429 with Retry-After
+func (rateLimit *RateLimit) Allow(endpoint string, clientKey string, now time.Time) error {
+	if err := rateLimit.checkQuotas(endpoint, clientKey, 0, now); err != nil {
+		return err
+	}
+	if rateLimit.Requests != nil {
+		if wait := rateLimit.Requests.Take(clientKey, 1, now); wait > 0 {
+			metrics.rateLimited.Add(1, endpoint, "requests")
+			return tooManyRequests(wait, "too many uploads, retry in %v", wait.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// AllowBytes takes the bytes read of the upload from the bucket of the client and checks the daily byte quota,
+// the error is 429 with Retry-After
+func (rateLimit *RateLimit) AllowBytes(endpoint string, clientKey string, size int64, now time.Time) error {
+	if rateLimit.DailyBytes > 0 {
+		if err := rateLimit.checkQuotas(endpoint, clientKey, size, now); err != nil {
+			return err
+		}
+	}
+	if rateLimit.Bytes != nil && size > 0 {
+		if wait := rateLimit.Bytes.Take(clientKey, float64(size), now); wait > 0 {
+			metrics.rateLimited.Add(1, endpoint, "bytes")
+			return tooManyRequests(wait, "too many bytes uploaded, retry in %v", wait.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// checkQuotas checks the usage of today and size more bytes against the daily quotas
+func (rateLimit *RateLimit) checkQuotas(endpoint string, clientKey string, size int64, now time.Time) error {
+	if rateLimit.DailyBytes <= 0 && rateLimit.DailyLines <= 0 {
+		return nil
+	}
+	usage, err := rateLimit.Quotas.Usage(endpoint, clientKey, now)
+	if err != nil {
+		return err
+	}
+	untilTomorrow := quotaDay(now).AddDate(0, 0, 1).Sub(now)
+	if rateLimit.DailyBytes > 0 && (usage.Bytes >= rateLimit.DailyBytes || usage.Bytes+size > rateLimit.DailyBytes) {
+		metrics.rateLimited.Add(1, endpoint, "quota_bytes")
+		return tooManyRequests(untilTomorrow, "daily quota of %d bytes is exceeded", rateLimit.DailyBytes)
+	}
+	if rateLimit.DailyLines > 0 && usage.Lines >= rateLimit.DailyLines {
+		metrics.rateLimited.Add(1, endpoint, "quota_lines")
+		return tooManyRequests(untilTomorrow, "daily quota of %d lines is exceeded", rateLimit.DailyLines)
+	}
+	return nil
+}
+
+// Used counts bytes and lines of the processed upload against the daily quotas
+func (rateLimit *RateLimit) Used(endpoint string, clientKey string, size int64, lines int64, now time.Time) error {
+	// clients are not metric labels, IP addresses and label values are unbounded
+	metrics.quotaBytes.Add(float64(size), endpoint)
+	metrics.quotaLines.Add(float64(lines), endpoint)
+	if rateLimit.DailyBytes <= 0 && rateLimit.DailyLines <= 0 {
+		return nil
+	}
+	return rateLimit.Quotas.Add(endpoint, clientKey, size, lines, now)
+}
+
+// TokenBuckets token bucket per client, rate is tokens per minute
+type TokenBuckets struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewTokenBuckets buckets of the rate per minute, burst defaults to the rate
+func NewTokenBuckets(perMinute float64, burst float64) *TokenBuckets {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &TokenBuckets{
+		rate:    perMinute / 60,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take takes n tokens from the bucket of the key, returns the wait until they are available if the bucket is short.
+// More tokens than the burst are taken from the full bucket, the debt delays the next take.
+func (buckets *TokenBuckets) Take(key string, n float64, now time.Time) time.Duration {
+	buckets.mu.Lock()
+	defer buckets.mu.Unlock()
+	bucket, exists := buckets.buckets[key]
+	if !exists {
+		if len(buckets.buckets) >= maxTokenBuckets {
+			buckets.evict(now)
+		}
+		bucket = &tokenBucket{tokens: buckets.burst, updated: now}
+		buckets.buckets[key] = bucket
+	}
+	bucket.tokens = min(buckets.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*buckets.rate)
+	bucket.updated = now
+	need := min(n, buckets.burst)
+	if bucket.tokens < need {
+		return time.Duration((need - bucket.tokens) / buckets.rate * float64(time.Second))
+	}
+	bucket.tokens -= n
+	return 0
+}
+
+func (buckets *TokenBuckets) evict(now time.Time) {
+	for key, bucket := range buckets.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*buckets.rate >= buckets.burst {
+			delete(buckets.buckets, key)
+		}
+	}
+}
+
+// QuotaStore daily usage per endpoint and client, survives restarts
+type QuotaStore struct {
+	store *FileStore
+	mu    sync.Mutex
+}
+
+// QuotaUsage bytes and lines of the day
+type QuotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Lines int64 `json:"lines"`
+}
+
+// OpenQuotaStore opens quota store in the storage directory
+func OpenQuotaStore(storageDir string) (*QuotaStore, error) {
+	store, err := OpenFileStore(filepath.Join(storageDir, "quotas"))
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaStore{store: store}, nil
+}
+
+// quotaDay start of the UTC day quotas are counted for
+func quotaDay(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour)
+}
+
+func quotaKey(endpoint string, clientKey string, now time.Time) string {
+	return quotaDay(now).Format("2006-01-02") + " " + endpoint + " " + clientKey
+}
+
+// Usage of the client today
+func (quotas *QuotaStore) Usage(endpoint string, clientKey string, now time.Time) (QuotaUsage, error) {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	var usage QuotaUsage
+	_, err := quotas.store.Get(quotaKey(endpoint, clientKey, now), &usage)
+	return usage, err
+}
+
+// Add adds bytes and lines to the usage of the client today
+func (quotas *QuotaStore) Add(endpoint string, clientKey string, size int64, lines int64, now time.Time) error {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	key := quotaKey(endpoint, clientKey, now)
+	var usage QuotaUsage
+	if _, err := quotas.store.Get(key, &usage); err != nil {
+		return err
+	}
+	usage.Bytes += size
+	usage.Lines += lines
+	return quotas.store.Put(key, usage, quotaUsageTTL)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stores and spools by kind and path, a reloaded config keeps using the ones already open
+var sharedStores = struct {
+	mu     sync.Mutex
+	stores map[string]interface{}
+}{stores: make(map[string]interface{})}
+
+func openShared(kind string, path string, open func() (interface{}, error)) (interface{}, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	key := kind + ":" + absPath
+	sharedStores.mu.Lock()
+	defer sharedStores.mu.Unlock()
+	if store, exists := sharedStores.stores[key]; exists {
+		return store, nil
+	}
+	store, err := open()
+	if err != nil {
+		return nil, err
+	}
+	sharedStores.stores[key] = store
+	return store, nil
+}
+
+// closeShared forgets the store, the next config opens it again
+func closeShared(store interface{}) {
+	sharedStores.mu.Lock()
+	defer sharedStores.mu.Unlock()
+	for key, shared := range sharedStores.stores {
+		if shared == store {
+			delete(sharedStores.stores, key)
+		}
+	}
+}
+
+// Listener HTTP server of the address, requests are served by the MoLog of the current config.
+// Connections are TLS when the current config has TLS, switching it on or off keeps the socket.
+type Listener struct {
+	address   string
+	server    *http.Server
+	tlsConfig *tls.Config
+	current   atomic.Pointer[MoLog]
+	drain     context.Context
+	abort     context.CancelFunc
+	mu        sync.Mutex
+	idle      map[net.Conn]bool
+}
+
+// bindListener listens on the address of the MoLog, Serve starts serving
+func bindListener(moLog *MoLog) (*Listener, net.Listener, error) {
+	netListener, err := net.Listen("tcp", moLog.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	listener := &Listener{
+		address: moLog.Address,
+		idle:    make(map[net.Conn]bool),
+	}
+	listener.drain, listener.abort = context.WithCancel(context.Background())
+	listener.server = &http.Server{Handler: listener, ConnState: listener.connState}
+	listener.tlsConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			listenerTLS := listener.current.Load().TLS
+			if listenerTLS == nil {
+				return nil, errors.New("TLS is switched off")
+			}
+			return listenerTLS.config(), nil
+		},
+	}
+	listener.swap(moLog)
+	return listener, netListener, nil
+}
+
+func (listener *Listener) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	listener.current.Load().ServeHTTP(responseWriter, request)
+}
+
+// swap makes the MoLog serve new requests, in-flight requests finish with the previous one.
+// When TLS is switched on or off idle connections are closed, the others after their request.
+func (listener *Listener) swap(moLog *MoLog) {
+	moLog.drain = listener.drain
+	listener.current.Store(moLog)
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	for conn := range listener.idle {
+		listener.closeSwitched(conn)
+	}
+}
+
+// connState keeps track of idle connections, a connection of the switched TLS mode isn't used again
+func (listener *Listener) connState(conn net.Conn, state http.ConnState) {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	delete(listener.idle, conn)
+	if state == http.StateIdle && !listener.closeSwitched(conn) {
+		listener.idle[conn] = true
+	}
+}
+
+// closeSwitched closes the connection if the current config switched TLS on or off since it was accepted
+func (listener *Listener) closeSwitched(conn net.Conn) bool {
+	_, isTLS := conn.(*tls.Conn)
+	if isTLS == (listener.current.Load().TLS != nil) {
+		return false
+	}
+	delete(listener.idle, conn)
+	conn.Close()
+	return true
+}
+
+func (listener *Listener) serve(netListener net.Listener) {
+	go func() {
+		err := listener.server.Serve(&switchingListener{Listener: netListener, listener: listener})
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[ERROR] Listener %v failed: %v", listener.address, err)
+		}
+	}()
+}
+
+// switchingListener accepts TLS connections while the current config of the listener has TLS
+type switchingListener struct {
+	net.Listener
+	listener *Listener
+}
+
+func (switching *switchingListener) Accept() (net.Conn, error) {
+	conn, err := switching.Listener.Accept()
+	if err != nil || switching.listener.current.Load().TLS == nil {
+		return conn, err
+	}
+	return tls.Server(conn, switching.listener.tlsConfig), nil
+}
+
+// Server listeners of the running config, the config is swapped on reload without dropping connections
+type Server struct {
+	configFile string
+	mu         sync.Mutex
+	listeners  map[string]*Listener
+}
+
+// NewServer server of the config file, Apply starts it
+func NewServer(configFile string) *Server {
+	return &Server{
+		configFile: configFile,
+		listeners:  make(map[string]*Listener),
+	}
+}
+
+// spools used by the MoLogs of the listeners
+func (server *Server) spools() map[*Spool]bool {
+	spools := make(map[*Spool]bool)
+	for _, listener := range server.listeners {
+		if spool := listener.current.Load().Spool; spool != nil {
+			spools[spool] = true
+		}
+	}
+	return spools
+}
+
+// Apply starts listeners of new addresses, swaps the config of running ones and drains the rest.
+// When an address can't be bound the running config is kept.
+func (server *Server) Apply(moLogs []*MoLog) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	previousSpools := server.spools()
+
+	// Bind new addresses first, so a failure leaves everything as it was
+	type bound struct {
+		listener    *Listener
+		netListener net.Listener
+	}
+	var started []bound
+	addresses := make(map[string]bool)
+	for _, moLog := range moLogs {
+		addresses[moLog.Address] = true
+		if _, exists := server.listeners[moLog.Address]; exists {
+			continue
+		}
+		listener, netListener, err := bindListener(moLog)
+		if err != nil {
+			for _, bound := range started {
+				bound.netListener.Close()
+			}
+			return fmt.Errorf("can't listen on %v: %v", moLog.Address, err)
+		}
+		started = append(started, bound{listener, netListener})
+	}
+
+	for _, moLog := range moLogs {
+		if moLog.Spool != nil {
+			moLog.Spool.Start()
+		}
+		if running, exists := server.listeners[moLog.Address]; exists {
+			running.swap(moLog)
+		}
+	}
+	var stopped []*Listener
+	for address, running := range server.listeners {
+		if !addresses[address] {
+			stopped = append(stopped, running)
+			delete(server.listeners, address)
+		}
+	}
+	for _, bound := range started {
+		server.listeners[bound.listener.address] = bound.listener
+		bound.listener.serve(bound.netListener)
+		log.Printf("[INFO] Listening on %v", bound.listener.address)
+	}
+	for _, running := range stopped {
+		go func(running *Listener) {
+			if err := running.Shutdown(running.current.Load().ShutdownTimeout); err != nil {
+				log.Printf("[ERROR] Listener %v didn't drain: %v", running.address, err)
+			}
+			log.Printf("[INFO] Listener %v stopped", running.address)
+		}(running)
+	}
+	// Spools of the previous config not used anymore stop replay, the rest stays in their directory
+	currentSpools := server.spools()
+	for spool := range previousSpools {
+		if !currentSpools[spool] {
+			closeShared(spool)
+			go spool.Stop(context.Background())
+		}
+	}
+	return nil
+}
+
+// Reload reads the config file again and applies it, invalid config leaves the running one untouched
+func (server *Server) Reload() error {
+	moLogs, err := LoadMoLog(server.configFile)
+	if err != nil {
+		return err
+	}
+	if err := server.Apply(moLogs); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Config %v reloaded", server.configFile)
+	return nil
+}
+
+// configFiles files and directories of the running config, included ones as well
+func (server *Server) configFiles() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, listener := range server.listeners {
+		return listener.current.Load().ConfigFiles
+	}
+	return []string{server.configFile}
+}
+
+// configModTimes modification times of the files, directories change when fragments are added or removed
+func configModTimes(configFiles []string) string {
+	var modTimes strings.Builder
+	for _, configFile := range configFiles {
+		if info, err := os.Stat(configFile); err == nil {
+			fmt.Fprintf(&modTimes, "%s %d\n", configFile, info.ModTime().UnixNano())
+		}
+	}
+	return modTimes.String()
+}
+
+// Watch reloads the config when the modification time of the file or of an included file changes
+func (server *Server) Watch(interval time.Duration) {
+	modTimes := configModTimes(server.configFiles())
+	for range time.Tick(interval) {
+		current := configModTimes(server.configFiles())
+		if current == modTimes {
+			continue
+		}
+		if err := server.Reload(); err != nil {
+			log.Printf("[ERROR] Config %v isn't reloaded, running config is kept: %v", server.configFile, err)
+		}
+		// files of the reloaded config, or of the kept one when the reload failed
+		modTimes = configModTimes(server.configFiles())
+	}
+}
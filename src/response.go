@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrorResponse JSON body of a rejected request
+type ErrorResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// StatusError error with the HTTP status for the client
+type StatusError struct {
+	Status     int
+	Err        error
+	RetryAfter string
+}
+
+func (err *StatusError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *StatusError) Unwrap() error {
+	return err.Err
+}
+
+// errorStatus HTTP status of the error, internal server error for unknown errors
+func errorStatus(err error) int {
+	var statusError *StatusError
+	var limitError *ArchiveLimitError
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &statusError):
+		return statusError.Status
+	case errors.As(err, &limitError):
+		return limitError.Status
+	case errors.As(err, &maxBytesError):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// errorRetryAfter value of Retry-After header for the error
+func errorRetryAfter(err error) string {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		if statusError.RetryAfter != "" {
+			return statusError.RetryAfter
+		}
+		if statusError.Status == http.StatusServiceUnavailable {
+			return "30"
+		}
+	}
+	return ""
+}
+
+func writeJSON(responseWriter http.ResponseWriter, status int, body interface{}) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode response: %v", err)
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	responseWriter.Write(payload)
+}
+
+func writeJSONError(responseWriter http.ResponseWriter, status int, message string) {
+	writeJSON(responseWriter, status, ErrorResponse{OK: false, Error: message})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultS3Region = "us-east-1"
+
+// MoLogS3 S3 object storage of uploaded archives
+type MoLogS3 struct {
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+	Bucket          string
+	Region          string
+
+	client *minio.Client
+}
+
+// NewMoLogS3 storage of the s3 sink
+func NewMoLogS3(sink ConfigS3Sink) (*MoLogS3, error) {
+	s3 := &MoLogS3{
+		Endpoint:        sink.Endpoint,
+		AccessKeyID:     sink.AccessKeyID,
+		SecretAccessKey: sink.SecretAccessKey,
+		UseSSL:          sink.UseSSL,
+		Bucket:          sink.Bucket,
+		Region:          sink.Region,
+	}
+	if s3.Endpoint == "" {
+		return nil, fmt.Errorf("s3 sink endpoint must be defined")
+	}
+	if s3.Region == "" {
+		s3.Region = defaultS3Region
+	}
+	client, err := minio.New(s3.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(s3.AccessKeyID, s3.SecretAccessKey, ""),
+		Secure: s3.UseSSL,
+		Region: s3.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 sink endpoint [%s]: %v", s3.Endpoint, err)
+	}
+	s3.client = client
+	return s3, nil
+}
+
+// Name of the storage in health checks
+func (s3 *MoLogS3) Name() string {
+	return "s3:" + s3.Endpoint + "/" + s3.Bucket
+}
+
+// Probe checks that the bucket (or the storage itself when bucket is not defined) is reachable with the credentials
+func (s3 *MoLogS3) Probe(ctx context.Context) error {
+	if s3.Bucket == "" {
+		_, err := s3.client.ListBuckets(ctx)
+		return err
+	}
+	exists, err := s3.client.BucketExists(ctx, s3.Bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", s3.Bucket)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Uploads still running at shutdown.timeout spool the rest of their lines, shutdownSpoolGrace is given for it
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	shutdownSpoolGrace     = 5 * time.Second
+)
+
+var errShuttingDown = &StatusError{Status: http.StatusServiceUnavailable, Err: errors.New("server is shutting down")}
+
+// draining reports whether the shutdown deadline is reached and pushes must go to the spool
+func (moLog *MoLog) draining() bool {
+	return moLog.drain != nil && moLog.drain.Err() != nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight uploads,
+// after the timeout they spool the lines not pushed yet instead of pushing them
+func (listener *Listener) Shutdown(timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, listener.abort)
+	defer timer.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+shutdownSpoolGrace)
+	defer cancel()
+	return listener.server.Shutdown(ctx)
+}
+
+// Shutdown drains all listeners in parallel, then stops replay of the spool(s)
+func (server *Server) Shutdown() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	spools := server.spools()
+	var wg sync.WaitGroup
+	for _, listener := range server.listeners {
+		wg.Add(1)
+		go func(listener *Listener) {
+			defer wg.Done()
+			if err := listener.Shutdown(listener.current.Load().ShutdownTimeout); err != nil {
+				log.Printf("[ERROR] Listener %v didn't drain: %v", listener.address, err)
+			} else {
+				log.Printf("[INFO] Listener %v stopped", listener.address)
+			}
+		}(listener)
+	}
+	wg.Wait()
+	for spool := range spools {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownSpoolGrace)
+		if err := spool.Stop(ctx); err != nil {
+			log.Printf("[WARN] Spool replay didn't stop: %v", err)
+		}
+		cancel()
+		log.Printf("[INFO] %d pushes left in the spool", spool.Depth())
+	}
+}
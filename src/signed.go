@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of signed upload URL, all other parameters are signed labels
+const (
+	signedURLExpires   = "expires"
+	signedURLMaxSize   = "max_size"
+	signedURLSignature = "signature"
+)
+
+var errSignedURLExpired = errors.New("signed URL expired")
+
+// loadSecret reads the secret inline, from the file or from the environment variable
+func loadSecret(secret string, secretFile string, secretEnv string) (string, error) {
+	switch {
+	case secretFile != "":
+		content, err := os.ReadFile(secretFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	case secretEnv != "":
+		return os.Getenv(secretEnv), nil
+	}
+	return secret, nil
+}
+
+// signedURLPayload what is signed: path, expiry, maximum size and labels in canonical (sorted) order
+func signedURLPayload(path string, expires string, maxSize string, labels url.Values) string {
+	return strings.Join([]string{path, expires, maxSize, labels.Encode()}, "\n")
+}
+
+func signURLPayload(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignUploadURL mints upload URL valid until expires, maxSize 0 keeps the endpoint limit
+func SignUploadURL(secret []byte, path string, labels url.Values, expires time.Time, maxSize int64) string {
+	query := url.Values{}
+	for label, values := range labels {
+		query[label] = values
+	}
+	expiresValue := strconv.FormatInt(expires.Unix(), 10)
+	maxSizeValue := ""
+	if maxSize > 0 {
+		maxSizeValue = strconv.FormatInt(maxSize, 10)
+		query.Set(signedURLMaxSize, maxSizeValue)
+	}
+	query.Set(signedURLExpires, expiresValue)
+	query.Set(signedURLSignature, signURLPayload(secret, signedURLPayload(path, expiresValue, maxSizeValue, labels)))
+	return path + "?" + query.Encode()
+}
+
+// verifySignedURL checks signature and expiry of the upload URL, signed labels of the query become labels of the principal
+func verifySignedURL(secret []byte, path string, query url.Values, now time.Time) (*Principal, error) {
+	signature := query.Get(signedURLSignature)
+	expires := query.Get(signedURLExpires)
+	maxSize := query.Get(signedURLMaxSize)
+	labels := url.Values{}
+	for label, values := range query {
+		if label != signedURLSignature && label != signedURLExpires && label != signedURLMaxSize {
+			labels[label] = values
+		}
+	}
+	expected := signURLPayload(secret, signedURLPayload(path, expires, maxSize, labels))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("%w: signature mismatch", errInvalidCredentials)
+	}
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid expires", errInvalidCredentials)
+	}
+	if now.Unix() > expiresUnix {
+		return nil, errSignedURLExpired
+	}
+	principal := &Principal{
+		Name:   "signed-url",
+		Labels: make(map[string]string, len(labels)),
+	}
+	// names are signed as given, they are sanitised when the labels are set
+	for label := range labels {
+		principal.Labels[label] = labels.Get(label)
+	}
+	if maxSize != "" {
+		if principal.MaxUploadSize, err = strconv.ParseInt(maxSize, 10, 64); err != nil || principal.MaxUploadSize <= 0 {
+			return nil, fmt.Errorf("%w: invalid max_size", errInvalidCredentials)
+		}
+	}
+	return principal, nil
+}
+
+// signUploadURL signs the upload path with its query labels by the secret of the endpoint
+func signUploadURL(list []*MoLog, rawURL string, ttl time.Duration, maxSize int64) (string, error) {
+	uploadURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	uploadPath := "/" + strings.Trim(uploadURL.Path, "/")
+	for _, moLog := range list {
+		if promtailConfig, exists := moLog.Promtails[uploadPath]; exists {
+			if len(promtailConfig.SignedURLSecret) == 0 {
+				return "", fmt.Errorf("auth.signed.url.secret isn't configured for upload path [%s]", uploadPath)
+			}
+			return SignUploadURL(promtailConfig.SignedURLSecret, uploadPath, uploadURL.Query(), time.Now().Add(ttl), maxSize), nil
+		}
+	}
+	return "", fmt.Errorf("upload path [%s] isn't configured", uploadPath)
+}
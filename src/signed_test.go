@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVerifySignedURL(t *testing.T) {
+	secret := []byte("signing secret")
+	now := time.Unix(1703279398, 0)
+	signed := func(labels url.Values, expires time.Time, maxSize int64) url.Values {
+		uploadURL, err := url.Parse(SignUploadURL(secret, "/upload", labels, expires, maxSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uploadURL.Query()
+	}
+	labels := url.Values{"device_id": {"d1"}, "app": {"crm"}}
+
+	for _, test := range []struct {
+		name   string
+		secret []byte
+		path   string
+		query  url.Values
+		modify func(query url.Values)
+		err    error
+	}{
+		{name: "valid", query: signed(labels, now.Add(time.Hour), 1024)},
+		{name: "expires now", query: signed(labels, now, 0)},
+		{name: "expired", query: signed(labels, now.Add(-time.Second), 0), err: errSignedURLExpired},
+		{name: "tampered label", query: signed(labels, now.Add(time.Hour), 0), modify: func(query url.Values) { query.Set("device_id", "d2") }, err: errInvalidCredentials},
+		{name: "added label", query: signed(labels, now.Add(time.Hour), 0), modify: func(query url.Values) { query.Set("env", "prod") }, err: errInvalidCredentials},
+		{name: "removed label", query: signed(labels, now.Add(time.Hour), 0), modify: func(query url.Values) { query.Del("app") }, err: errInvalidCredentials},
+		{name: "extended expiry", query: signed(labels, now.Add(-time.Second), 0), modify: func(query url.Values) { query.Set(signedURLExpires, "4102444800") }, err: errInvalidCredentials},
+		{name: "raised max size", query: signed(labels, now.Add(time.Hour), 1024), modify: func(query url.Values) { query.Set(signedURLMaxSize, "1048576") }, err: errInvalidCredentials},
+		{name: "dropped max size", query: signed(labels, now.Add(time.Hour), 1024), modify: func(query url.Values) { query.Del(signedURLMaxSize) }, err: errInvalidCredentials},
+		{name: "missing signature", query: signed(labels, now.Add(time.Hour), 0), modify: func(query url.Values) { query.Del(signedURLSignature) }, err: errInvalidCredentials},
+		{name: "wrong key", secret: []byte("other secret"), query: signed(labels, now.Add(time.Hour), 0), err: errInvalidCredentials},
+		{name: "other path", path: "/other", query: signed(labels, now.Add(time.Hour), 0), err: errInvalidCredentials},
+	} {
+		if test.secret == nil {
+			test.secret = secret
+		}
+		if test.path == "" {
+			test.path = "/upload"
+		}
+		if test.modify != nil {
+			test.modify(test.query)
+		}
+		principal, err := verifySignedURL(test.secret, test.path, test.query, now)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if principal.Labels["device_id"] != "d1" || principal.Labels["app"] != "crm" || len(principal.Labels) != 2 {
+			t.Errorf("%s: labels %v", test.name, principal.Labels)
+		}
+	}
+}
+
+func TestVerifySignedURLMaxSize(t *testing.T) {
+	secret := []byte("signing secret")
+	now := time.Now()
+	uploadURL, _ := url.Parse(SignUploadURL(secret, "/upload", nil, now.Add(time.Hour), 1024))
+	principal, err := verifySignedURL(secret, "/upload", uploadURL.Query(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.MaxUploadSize != 1024 || len(principal.Labels) != 0 {
+		t.Fatalf("principal %+v", principal)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSpoolMaxSize = 256 << 20
+
+// Replay of the spool is retried with growing interval up to the maximum
+const (
+	spoolReplayInterval    = 5 * time.Second
+	spoolReplayMaxInterval = 5 * time.Minute
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// Spool keeps push requests promtail didn't accept (unavailable or failed) on disk and replays them in background
+type Spool struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	size    int64
+	depth   int
+	seq     int64
+	once    sync.Once
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type spooledPush struct {
+	URL    string          `json:"url"`
+	Tenant string          `json:"tenant,omitempty"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// OpenSpool opens the spool directory, pushes spooled by the previous run are replayed as well
+func OpenSpool(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		maxSize = defaultSpoolMaxSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	spool := &Spool{
+		dir:     dir,
+		maxSize: maxSize,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	files, err := spool.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			spool.size += info.Size()
+			spool.depth++
+		}
+	}
+	return spool, nil
+}
+
+// files spooled pushes in the order they were spooled
+func (spool *Spool) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(spool.dir, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+// Put persists the push request, fails with errSpoolFull when the spool size limit is reached
+func (spool *Spool) Put(url string, tenant string, body []byte) error {
+	content, err := json.Marshal(spooledPush{url, tenant, body})
+	if err != nil {
+		return err
+	}
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	if spool.size+int64(len(content)) > spool.maxSize {
+		return errSpoolFull
+	}
+	spool.seq++
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), spool.seq%1000000)
+	tmpPath := filepath.Join(spool.dir, name+".tmp")
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, strings.TrimSuffix(tmpPath, ".tmp")); err != nil {
+		return err
+	}
+	spool.size += int64(len(content))
+	spool.depth++
+	return nil
+}
+
+// SpoolRequest persists the push request built by makePromtailRequest
+func (spool *Spool) SpoolRequest(promtailRequest *http.Request) error {
+	body, err := promtailRequest.GetBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	buffer := new(bytes.Buffer)
+	if _, err := buffer.ReadFrom(body); err != nil {
+		return err
+	}
+	return spool.Put(promtailRequest.URL.String(), promtailRequest.Header.Get(LokiTenantHeader), buffer.Bytes())
+}
+
+// SetMaxSize changes the size limit of the spool
+func (spool *Spool) SetMaxSize(maxSize int64) {
+	if maxSize <= 0 {
+		maxSize = defaultSpoolMaxSize
+	}
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	spool.maxSize = maxSize
+}
+
+// Full reports whether the spool reached its size limit
+func (spool *Spool) Full() bool {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.size >= spool.maxSize
+}
+
+// Depth number of spooled push requests
+func (spool *Spool) Depth() int {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.depth
+}
+
+// Size bytes of spooled push requests
+func (spool *Spool) Size() int64 {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.size
+}
+
+// Start starts background replay once, whatever number of listeners share the spool
+func (spool *Spool) Start() {
+	spool.once.Do(func() {
+		go spool.replayLoop()
+	})
+}
+
+// Stop stops background replay and waits for the running replay
+func (spool *Spool) Stop(ctx context.Context) error {
+	started := true
+	spool.once.Do(func() {
+		started = false
+	})
+	if !started {
+		return nil
+	}
+	close(spool.stop)
+	select {
+	case <-spool.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (spool *Spool) replayLoop() {
+	defer close(spool.stopped)
+	interval := spoolReplayInterval
+	for {
+		select {
+		case <-spool.stop:
+			return
+		case <-time.After(interval):
+		}
+		if err := spool.Replay(); err != nil {
+			log.Printf("[WARN] Spool replay stopped: %v", err)
+			interval = min(interval*2, spoolReplayMaxInterval)
+		} else {
+			interval = spoolReplayInterval
+		}
+	}
+}
+
+// Replay pushes spooled requests in order, stops on the first push promtail didn't accept
+func (spool *Spool) Replay() error {
+	files, err := spool.files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		select {
+		case <-spool.stop:
+			return nil
+		default:
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var push spooledPush
+		if err := json.Unmarshal(content, &push); err == nil {
+			promtailRequest, err := http.NewRequest("POST", push.URL, bytes.NewReader(push.Body))
+			if err != nil {
+				return err
+			}
+			promtailRequest.Header.Set("Content-Type", "application/json")
+			if push.Tenant != "" {
+				promtailRequest.Header.Set(LokiTenantHeader, push.Tenant)
+			}
+			metrics.pushRetries.Add(1)
+			err = pushPromtail(promtailRequest)
+			var promtailError *PromtailError
+			if errors.As(err, &promtailError) {
+				log.Printf("[ERROR] Spooled push %v dropped: %v", filepath.Base(file), err)
+			} else if err != nil {
+				return err
+			}
+		} else {
+			log.Printf("[ERROR] Spooled push %v is corrupted, dropped: %v", filepath.Base(file), err)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		spool.mu.Lock()
+		spool.size -= int64(len(content))
+		spool.depth--
+		spool.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultStorageDir = "data"
+
+// Expired entries are removed from the store directory at most this often
+const fileStoreSweepInterval = time.Hour
+
+// FileStore persistent key-value store keeping a JSON file per key in its directory, entries may expire.
+// Writing an entry doesn't touch the others, callers serialize writes of the same key.
+type FileStore struct {
+	dir       string
+	files     sync.RWMutex // writes share it, sweep holds it while removing an expired file
+	mu        sync.Mutex
+	lastSweep time.Time
+	sweeping  bool
+}
+
+type fileStoreEntry struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expires.at,omitempty"`
+}
+
+func (entry fileStoreEntry) expired(now time.Time) bool {
+	return !entry.ExpiresAt.IsZero() && now.After(entry.ExpiresAt)
+}
+
+// OpenFileStore opens the store directory and removes its expired entries
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &FileStore{dir: dir}
+	// writes interrupted by the previous run
+	tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	for _, tmpFile := range tmpFiles {
+		os.Remove(tmpFile)
+	}
+	store.sweep(time.Now())
+	return store, nil
+}
+
+// path file of the key, keys are hashed so any string is a valid key
+func (store *FileStore) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(store.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// Get decodes the value of a not expired key, returns false when there is no such key
+func (store *FileStore) Get(key string, value interface{}) (bool, error) {
+	entry, err := readFileStoreEntry(store.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if entry.expired(time.Now()) {
+		return false, nil
+	}
+	return true, json.Unmarshal(entry.Value, value)
+}
+
+// Put stores the value in the file of the key, zero ttl means the key never expires
+func (store *FileStore) Put(key string, value interface{}, ttl time.Duration) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entry := fileStoreEntry{Value: payload}
+	if ttl > 0 {
+		entry.ExpiresAt = now.Add(ttl)
+	}
+	if err := store.write(key, entry); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.sweeping && now.Sub(store.lastSweep) >= fileStoreSweepInterval {
+		store.sweeping = true
+		go store.sweep(now)
+	}
+	return nil
+}
+
+// write atomically replaces the file of the key
+func (store *FileStore) write(key string, entry fileStoreEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := store.path(key)
+	store.files.RLock()
+	defer store.files.RUnlock()
+	tmpFile, err := os.CreateTemp(store.dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// sweep removes files of expired entries
+func (store *FileStore) sweep(now time.Time) {
+	files, err := filepath.Glob(filepath.Join(store.dir, "*.json"))
+	if err != nil {
+		log.Printf("[ERROR] Can't list store %s: %v", store.dir, err)
+	}
+	for _, file := range files {
+		store.files.Lock()
+		if entry, err := readFileStoreEntry(file); err == nil && entry.expired(now) {
+			os.Remove(file)
+		}
+		store.files.Unlock()
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.lastSweep = now
+	store.sweeping = false
+}
+
+func readFileStoreEntry(path string) (fileStoreEntry, error) {
+	var entry fileStoreEntry
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	return entry, json.Unmarshal(content, &entry)
+}
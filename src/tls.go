@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate files are checked for changes at most this often, on TLS handshakes
+const certificateCheckInterval = 5 * time.Second
+
+const defaultTLSMinVersion = tls.VersionTLS12
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ListenerTLS server TLS of the listener, the certificate is selected by SNI
+type ListenerTLS struct {
+	Certificates []*ReloadingCertificate
+	MinVersion   uint16
+	CipherSuites []uint16
+	Client       *ClientTLS
+}
+
+// ReloadingCertificate key pair that is loaded again when its files change,
+// a pair that can't be loaded is logged and the previous one is kept
+type ReloadingCertificate struct {
+	CertFile string
+	KeyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTimes    string
+	checked     time.Time
+}
+
+// LoadCertificate loads the key pair of the files
+func LoadCertificate(certFile string, keyFile string) (*ReloadingCertificate, error) {
+	certificate := &ReloadingCertificate{CertFile: certFile, KeyFile: keyFile}
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certificate.certificate = &keyPair
+	certificate.modTimes = certificate.fileModTimes()
+	certificate.checked = time.Now()
+	return certificate, nil
+}
+
+func (certificate *ReloadingCertificate) fileModTimes() string {
+	var modTimes []string
+	for _, file := range []string{certificate.CertFile, certificate.KeyFile} {
+		if info, err := os.Stat(file); err == nil {
+			modTimes = append(modTimes, info.ModTime().String())
+		}
+	}
+	return strings.Join(modTimes, ",")
+}
+
+// Certificate current key pair, reloaded when the files changed since the last check
+func (certificate *ReloadingCertificate) Certificate() *tls.Certificate {
+	certificate.mu.Lock()
+	defer certificate.mu.Unlock()
+	if time.Since(certificate.checked) < certificateCheckInterval {
+		return certificate.certificate
+	}
+	certificate.checked = time.Now()
+	modTimes := certificate.fileModTimes()
+	if modTimes == certificate.modTimes {
+		return certificate.certificate
+	}
+	keyPair, err := tls.LoadX509KeyPair(certificate.CertFile, certificate.KeyFile)
+	if err != nil {
+		// files may be replaced one after the other, the next check tries again
+		log.Printf("[ERROR] Certificate %v isn't reloaded, previous one is kept: %v", certificate.CertFile, err)
+		return certificate.certificate
+	}
+	certificate.certificate = &keyPair
+	certificate.modTimes = modTimes
+	log.Printf("[INFO] Certificate %v reloaded", certificate.CertFile)
+	return certificate.certificate
+}
+
+// certificate first certificate valid for the server name (SNI) and the client capabilities,
+// the first certificate when none matches
+func (listenerTLS *ListenerTLS) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var first *tls.Certificate
+	for _, reloading := range listenerTLS.Certificates {
+		certificate := reloading.Certificate()
+		if first == nil {
+			first = certificate
+		}
+		if hello.SupportsCertificate(certificate) == nil {
+			return certificate, nil
+		}
+	}
+	return first, nil
+}
+
+// config server TLS config of the listener, with client authentication if configured
+func (listenerTLS *ListenerTLS) config() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: listenerTLS.certificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     listenerTLS.MinVersion,
+		CipherSuites:   listenerTLS.CipherSuites,
+	}
+	if listenerTLS.Client != nil {
+		config.ClientCAs = listenerTLS.Client.CAs
+		config.ClientAuth = listenerTLS.Client.Auth
+	}
+	return config
+}
+
+// client client authentication of the listener, nil without TLS
+func (listenerTLS *ListenerTLS) client() *ClientTLS {
+	if listenerTLS == nil {
+		return nil
+	}
+	return listenerTLS.Client
+}
+
+// tlsVersionNames supported values of min.version
+func tlsVersionNames() []string {
+	names := make([]string, 0, len(tlsVersions))
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newListenerTLS validates the TLS config of the listener and loads its certificates
+func newListenerTLS(tlsConfig ConfigTLS, tlsPath []interface{}, checker *configChecker) *ListenerTLS {
+	at := func(key ...interface{}) []interface{} {
+		return append(tlsPath[:len(tlsPath):len(tlsPath)], key...)
+	}
+	listenerTLS := &ListenerTLS{MinVersion: defaultTLSMinVersion}
+	pairs := tlsConfig.Certificates
+	pairPaths := make([][]interface{}, len(pairs))
+	for i := range pairs {
+		pairPaths[i] = at("certificates", i)
+	}
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		// cert.file and key.file are the certificate used when no other one matches the server name
+		pairs = append([]ConfigCertificate{{CertFile: tlsConfig.CertFile, KeyFile: tlsConfig.KeyFile}}, pairs...)
+		pairPaths = append([][]interface{}{tlsPath}, pairPaths...)
+	}
+	if len(pairs) == 0 {
+		checker.add(tlsPath, "cert.file and key.file or certificates must be defined")
+	}
+	for i, pair := range pairs {
+		pairPath := pairPaths[i]
+		if pair.CertFile != "" && pair.KeyFile == "" {
+			checker.add(append(pairPath[:len(pairPath):len(pairPath)], "cert.file"), "key.file must be defined as well")
+		} else if pair.CertFile == "" && pair.KeyFile != "" {
+			checker.add(append(pairPath[:len(pairPath):len(pairPath)], "key.file"), "cert.file must be defined as well")
+		} else if pair.CertFile == "" {
+			checker.add(pairPath, "cert.file and key.file must be defined")
+		} else if certExists, keyExists := fileExists(pair.CertFile), fileExists(pair.KeyFile); !certExists || !keyExists {
+			if !certExists {
+				checker.missingFile(append(pairPath[:len(pairPath):len(pairPath)], "cert.file"), "certificate file %s does not exist", pair.CertFile)
+			}
+			if !keyExists {
+				checker.missingFile(append(pairPath[:len(pairPath):len(pairPath)], "key.file"), "key file %s does not exist", pair.KeyFile)
+			}
+		} else if certificate, err := LoadCertificate(pair.CertFile, pair.KeyFile); err != nil {
+			checker.add(append(pairPath[:len(pairPath):len(pairPath)], "cert.file"), "invalid certificate: %v", err)
+		} else {
+			listenerTLS.Certificates = append(listenerTLS.Certificates, certificate)
+		}
+	}
+	if tlsConfig.MinVersion != "" {
+		version, exists := tlsVersions[tlsConfig.MinVersion]
+		if !exists {
+			checker.add(at("min.version"), "min.version must be one of %s, not [%s]", strings.Join(tlsVersionNames(), ", "), tlsConfig.MinVersion)
+		}
+		listenerTLS.MinVersion = version
+	}
+	if len(tlsConfig.CipherSuites) > 0 {
+		suites := make(map[string]*tls.CipherSuite)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite
+		}
+		for i, name := range tlsConfig.CipherSuites {
+			suite, exists := suites[name]
+			switch {
+			case !exists:
+				checker.add(at("cipher.suites", i), "unknown or insecure cipher suite [%s]", name)
+			case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+				checker.add(at("cipher.suites", i), "cipher suites of TLS 1.3 are not configurable [%s]", name)
+			default:
+				listenerTLS.CipherSuites = append(listenerTLS.CipherSuites, suite.ID)
+			}
+		}
+	}
+	if tlsConfig.ClientCAFile != "" && !fileExists(tlsConfig.ClientCAFile) {
+		checker.missingFile(at("client.ca.file"), "client CA file %s does not exist", tlsConfig.ClientCAFile)
+	} else if tlsConfig.ClientCAFile != "" {
+		clientTLS, err := NewClientTLS(tlsConfig.ClientCAFile, tlsConfig.ClientAuth, tlsConfig.ClientLabels)
+		if err != nil {
+			checker.add(at("client.ca.file"), "%v", err)
+		}
+		listenerTLS.Client = clientTLS
+	}
+	return listenerTLS
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Not more errors are reported in the upload response
+const maxUploadResultErrors = 20
+
+// UploadResult JSON body of the upload response
+type UploadResult struct {
+	OK                   bool               `json:"ok"`
+	UploadID             string             `json:"upload_id"`
+	File                 string             `json:"file,omitempty"`
+	Files                []UploadFileResult `json:"files"`
+	LinesParsed          int                `json:"lines_parsed"`
+	LinesPushed          int                `json:"lines_pushed"`
+	LinesRejected        int                `json:"lines_rejected"`
+	LinesSpooled         int                `json:"lines_spooled"`
+	LinesAlreadyPushed   int                `json:"lines_already_pushed"`
+	DuplicatesSuppressed int                `json:"duplicates_suppressed"`
+	Errors               []string           `json:"errors,omitempty"`
+	Duplicate            bool               `json:"duplicate,omitempty"`
+}
+
+// UploadFileResult lines of one log file of the archive
+type UploadFileResult struct {
+	Name          string `json:"name"`
+	LinesParsed   int    `json:"lines_parsed"`
+	LinesPushed   int    `json:"lines_pushed"`
+	LinesRejected int    `json:"lines_rejected"`
+}
+
+func newUploadID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func newUploadResult(uploadID string) *UploadResult {
+	return &UploadResult{
+		OK:       true,
+		UploadID: uploadID,
+		Files:    []UploadFileResult{},
+	}
+}
+
+// addError records the error, the result is not OK anymore
+func (result *UploadResult) addError(err error) {
+	result.OK = false
+	result.addWarning(err)
+}
+
+// addWarning records the error (e.g. rejected line) without failing the upload
+func (result *UploadResult) addWarning(err error) {
+	if len(result.Errors) < maxUploadResultErrors {
+		result.Errors = append(result.Errors, err.Error())
+	}
+}
+
+// reject counts the rejected line of the file
+func (result *UploadResult) reject(fileResult *UploadFileResult, err error) {
+	fileResult.LinesRejected++
+	result.LinesRejected++
+	result.addWarning(err)
+}
+
+// rateLimited answers the upload refused by the rate limit, 429 with Retry-After
+func rateLimited(responseWriter http.ResponseWriter, request *http.Request, clientKey string, result *UploadResult, err error) {
+	log.Printf("[WARN] Upload to %v from %v is rate limited: %v", request.URL.Path, clientKey, err)
+	if retryAfter := errorRetryAfter(err); retryAfter != "" {
+		responseWriter.Header().Set("Retry-After", retryAfter)
+	}
+	result.addError(err)
+	writeJSON(responseWriter, errorStatus(err), result)
+}
+
+func (moLog *MoLog) serveUpload(responseWriter http.ResponseWriter, request *http.Request, promtailConfig *MoLogPromtail) {
+	result := newUploadResult(newUploadID())
+	if request.Method != http.MethodPost && request.Method != http.MethodPut {
+		responseWriter.Header().Set("Allow", "POST, PUT")
+		result.addError(fmt.Errorf("method %s is not allowed", request.Method))
+		writeJSON(responseWriter, http.StatusMethodNotAllowed, result)
+		return
+	}
+	principal, err := promtailConfig.authenticate(request)
+	if err == nil {
+		principal, err = moLog.TLS.client().authenticate(request, principal)
+	}
+	if err != nil {
+		authenticationFailed(responseWriter, request, err)
+		return
+	}
+	var clientKey string
+	if promtailConfig.RateLimit != nil {
+		clientKey = promtailConfig.RateLimit.ClientKey(request, principal)
+		if err := promtailConfig.RateLimit.Allow(request.URL.Path, clientKey, time.Now()); err != nil {
+			rateLimited(responseWriter, request, clientKey, result, err)
+			return
+		}
+	}
+
+	uploadQuery, err := promtailConfig.parseQuery(request.URL.Query())
+	if err != nil {
+		log.Printf("[WARN] Upload to %v from %v rejected: %v", request.URL.Path, clientIP(request), err)
+		result.addError(err)
+		writeJSON(responseWriter, errorStatus(err), result)
+		return
+	}
+
+	// Upload file, the compressed size is limited on the whole request body
+	maxUploadSize := moLog.MaxUploadSize
+	if principal != nil && principal.MaxUploadSize > 0 {
+		maxUploadSize = min(maxUploadSize, principal.MaxUploadSize)
+	}
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, maxUploadSize)
+	uploadedFile, uploadedFileInfo, err := request.FormFile("file")
+	if err != nil {
+		log.Printf("[ERROR] Failed to obtain form file: %v", err)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			err = &StatusError{Status: http.StatusRequestEntityTooLarge, Err: fmt.Errorf("upload exceeds %d bytes", maxBytesError.Limit)}
+		} else if errors.Is(err, http.ErrNotMultipart) {
+			err = &StatusError{Status: http.StatusUnsupportedMediaType, Err: fmt.Errorf("multipart/form-data with the file field is expected: %v", err)}
+		} else {
+			err = &StatusError{Status: http.StatusBadRequest, Err: err}
+		}
+		result.addError(err)
+		writeJSON(responseWriter, errorStatus(err), result)
+		return
+	}
+	defer uploadedFile.Close()
+	result.File = uploadedFileInfo.Filename
+	metrics.uploadBytes.Add(float64(uploadedFileInfo.Size), request.URL.Path)
+	// Bytes are charged as read, chunked uploads have no Content-Length
+	if promtailConfig.RateLimit != nil {
+		if err := promtailConfig.RateLimit.AllowBytes(request.URL.Path, clientKey, uploadedFileInfo.Size, time.Now()); err != nil {
+			rateLimited(responseWriter, request, clientKey, result, err)
+			return
+		}
+	}
+
+	// Retried uploads are answered with the original result
+	idempotencyKey, contentHash, err := uploadIdempotencyKey(request, uploadedFile)
+	if err != nil {
+		log.Printf("[ERROR] Failed to hash uploaded file %v: %v", uploadedFileInfo.Filename, err)
+		result.addError(err)
+		writeJSON(responseWriter, http.StatusInternalServerError, result)
+		return
+	}
+	if moLog.Idempotency != nil {
+		previousResult, err := moLog.Idempotency.Begin(idempotencyKey, contentHash)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUploadInProgress) {
+				responseWriter.Header().Set("Retry-After", "5")
+				status = http.StatusConflict
+			} else if errors.Is(err, errIdempotencyKeyReused) {
+				status = http.StatusUnprocessableEntity
+			} else {
+				log.Printf("[ERROR] Failed to read idempotency store: %v", err)
+			}
+			result.addError(err)
+			writeJSON(responseWriter, status, result)
+			return
+		}
+		if previousResult != nil {
+			log.Printf("[INFO] Upload %v of %v was already processed, skip it", previousResult.UploadID, uploadedFileInfo.Filename)
+			previousResult.Duplicate = true
+			writeJSON(responseWriter, http.StatusOK, previousResult)
+			return
+		}
+	}
+
+	err = moLog.ingest(result, request, principal, uploadQuery, uploadedFile, uploadedFileInfo, promtailConfig)
+	if promtailConfig.RateLimit != nil {
+		if err := promtailConfig.RateLimit.Used(request.URL.Path, clientKey, uploadedFileInfo.Size, int64(result.LinesPushed+result.LinesSpooled), time.Now()); err != nil {
+			log.Printf("[ERROR] Failed to save quota store: %v", err)
+		}
+	}
+	if err == nil && result.LinesPushed == 0 && result.LinesSpooled == 0 && result.LinesRejected > 0 {
+		err = &StatusError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("all %d lines are rejected", result.LinesRejected)}
+	}
+	status := http.StatusOK
+	if result.LinesSpooled > 0 {
+		// Spooled lines are pushed later
+		status = http.StatusAccepted
+	}
+	if err != nil {
+		status = errorStatus(err)
+		if retryAfter := errorRetryAfter(err); retryAfter != "" {
+			responseWriter.Header().Set("Retry-After", retryAfter)
+		}
+		result.addError(err)
+	}
+	if moLog.Idempotency != nil {
+		var processedResult *UploadResult
+		if result.OK {
+			processedResult = result
+		}
+		if err := moLog.Idempotency.Finish(idempotencyKey, contentHash, processedResult); err != nil {
+			log.Printf("[ERROR] Failed to save idempotency store: %v", err)
+		}
+	}
+	writeJSON(responseWriter, status, result)
+}
+
+// ingest unpacks the uploaded archive and pushes its log lines to promtail, counters are collected into the result
+func (moLog *MoLog) ingest(result *UploadResult, request *http.Request, principal *Principal, uploadQuery *UploadQuery, uploadedFile multipart.File, uploadedFileInfo *multipart.FileHeader, promtailConfig *MoLogPromtail) error {
+	// Construct path for push API (keywords for search: grafana.com promtail-push-api plaintext payload)
+	baseStreams := make(map[string]*string)
+	// Read basic label, value pairs from query string
+	setLabels(baseStreams, uploadQuery.Labels)
+	endpoint := request.URL.Path
+	receivedAt := time.Now()
+	filename := uploadedFileInfo.Filename // Additional label
+	log.Printf("Filename is %v (upload %v)", filename, result.UploadID)
+	filenameInfo := parseFilename(promtailConfig.FilenamePattern, filename, receivedAt)
+	if !filenameInfo.Matched {
+		log.Printf("[WARN] Filename %v doesn't match filename.pattern, upload time is used as base date", filename)
+	}
+	// Labels of the filename override the query
+	setLabels(baseStreams, filenameInfo.Labels)
+	// Labels of the endpoint override the query and the filename
+	labelContext := LabelContext{
+		Filename: filenameInfo.Labels,
+		Header:   request.Header,
+		ClientIP: clientIP(request),
+		UploadID: result.UploadID,
+	}
+	setLabels(baseStreams, labelContext.Values(promtailConfig.Labels))
+	// Labels of the authenticated client override whatever the client sent
+	if principal != nil {
+		setLabels(baseStreams, principal.Labels)
+	}
+
+	// Rolling log files of the device overlap, lines of earlier uploads are skipped
+	var deviceState *DeviceState
+	if promtailConfig.DeviceDedup && moLog.Devices != nil {
+		var err error
+		deviceState, err = moLog.Devices.Acquire(deviceKey(request.URL.Path, promtailConfig.deviceLabels(baseStreams)), promtailConfig.DedupWindow)
+		if err != nil {
+			log.Printf("[ERROR] Failed to read device state: %v", err)
+			return err
+		}
+		defer func() {
+			if err := moLog.Devices.Release(deviceState); err != nil {
+				log.Printf("[ERROR] Failed to save device state: %v", err)
+			}
+		}()
+	}
+
+	// Read and unzip file
+	zipReader, err := zip.NewReader(uploadedFile, uploadedFileInfo.Size)
+	if err != nil {
+		log.Printf("[ERROR] Error read archive file %v (error: %v)", filename, err)
+		if errors.Is(err, zip.ErrFormat) {
+			return &StatusError{Status: http.StatusUnsupportedMediaType, Err: fmt.Errorf("%v is not a zip archive", filename)}
+		}
+		return &StatusError{Status: http.StatusUnprocessableEntity, Err: err}
+	}
+	archiveLimits := &promtailConfig.ArchiveLimits
+	if err := archiveLimits.Check(zipReader); err != nil {
+		log.Printf("[ERROR] Archive %v rejected: %v", filename, err)
+		return err
+	}
+	var unpackedSize int64
+	var promtailFailure error
+	// occurrences of the records in the entries read so far, the most of any one entry
+	var archiveRecords map[uint64]int
+	if promtailConfig.ArchiveDedup {
+		archiveRecords = make(map[uint64]int)
+	}
+	for _, packedFile := range zipReader.File {
+		if !promtailConfig.ingestEntry(packedFile.Name) {
+			continue
+		}
+		metrics.archiveEntries.Add(1, endpoint)
+		result.Files = append(result.Files, UploadFileResult{Name: packedFile.Name})
+		fileResult := &result.Files[len(result.Files)-1]
+		packedFileReadCloser, err := archiveLimits.Open(packedFile, &unpackedSize)
+		if err != nil {
+			log.Printf("[ERROR] Error unpacked file %v from archive %v (error: %v)", packedFile.Name, filename, err)
+			return &StatusError{Status: http.StatusUnprocessableEntity, Err: err}
+		}
+		defer packedFileReadCloser.Close()
+		entryRecords := make(map[uint64]int)
+		packedFileScanner := bufio.NewScanner(packedFileReadCloser)
+		packedFileScanner.Split(bufio.ScanLines)
+		lineNumber := 0
+		for packedFileScanner.Scan() {
+			rawPushPayload := packedFileScanner.Text()
+			lineNumber++
+			if rawPushPayload == "" {
+				continue
+			}
+
+			logLine, err := parseLogLine(rawPushPayload)
+			if err != nil {
+				metrics.linesRejected.Add(1, endpoint, "parse")
+				result.reject(fileResult, fmt.Errorf("%v:%d: %v", packedFile.Name, lineNumber, err))
+				continue
+			}
+			fileResult.LinesParsed++
+			result.LinesParsed++
+			metrics.linesParsed.Add(1, endpoint)
+			timestamp := logLine.Timestamp(filenameInfo)
+			metrics.lineLag.Observe(max(receivedAt.Sub(timestamp).Seconds(), 0), endpoint)
+
+			// Info.log and Verbose.log of the same archive hold the same records, identical records
+			// of one entry are real lines, only as many as another entry had are duplicates
+			if archiveRecords != nil {
+				recordHash := logLine.recordHash(timestamp)
+				entryRecords[recordHash]++
+				if entryRecords[recordHash] <= archiveRecords[recordHash] {
+					metrics.linesSkipped.Add(1, endpoint, "archive_duplicate")
+					result.DuplicatesSuppressed++
+					continue
+				}
+			}
+
+			// Push to promtail
+			streams := maps.Clone(baseStreams)
+			streams["level"] = &logLine.Level
+			if logLine.IsTag {
+				streams["tag"] = &logLine.Tag
+			} else {
+				streams["source"] = &logLine.Source
+			}
+
+			var hash uint64
+			if deviceState != nil {
+				hash = lineHash(timestamp, rawPushPayload)
+				if deviceState.Pushed(timestamp, hash) {
+					metrics.linesSkipped.Add(1, endpoint, "already_pushed")
+					result.LinesAlreadyPushed++
+					continue
+				}
+			}
+
+			// Make post request to promtail
+			promtailRequest, err := makePromtailRequest(
+				streams,
+				timestamp,
+				rawPushPayload,
+				uploadQuery.Metadata,
+				promtailConfig,
+			)
+			if err != nil {
+				log.Printf("[ERROR] Failed make request: %v", err)
+				return err
+			}
+			if principal != nil && principal.Tenant != "" {
+				promtailRequest.Header.Set(LokiTenantHeader, principal.Tenant)
+			}
+			// Once promtail failed or the shutdown deadline is reached, the rest of the upload goes to the spool directly
+			if promtailFailure == nil && moLog.draining() {
+				promtailFailure = errShuttingDown
+			}
+			if promtailFailure == nil {
+				if moLog.drain != nil {
+					promtailRequest = promtailRequest.WithContext(moLog.drain)
+				}
+				err = pushPromtail(promtailRequest)
+			} else {
+				err = promtailFailure
+			}
+			var promtailError *PromtailError
+			var spoolErr error
+			if err != nil && !errors.As(err, &promtailError) && moLog.Spool != nil {
+				spoolErr = moLog.Spool.SpoolRequest(promtailRequest)
+			}
+			// the push body goes back to the pool, the line is pushed, rejected or spooled
+			releasePromtailRequest(promtailRequest)
+			if promtailError != nil {
+				metrics.linesRejected.Add(1, endpoint, "promtail")
+				result.reject(fileResult, fmt.Errorf("%v:%d: %v", packedFile.Name, lineNumber, err))
+				continue
+			} else if err != nil {
+				if moLog.Spool == nil {
+					return err
+				}
+				if spoolErr != nil {
+					log.Printf("[ERROR] Failed to spool push: %v", spoolErr)
+					return err
+				}
+				promtailFailure = err
+				if moLog.draining() {
+					promtailFailure = errShuttingDown
+				}
+				result.LinesSpooled++
+				metrics.linesSpooled.Add(1, endpoint)
+			} else {
+				fileResult.LinesPushed++
+				result.LinesPushed++
+				metrics.linesPushed.Add(1, endpoint)
+			}
+			if deviceState != nil {
+				deviceState.Add(timestamp, hash)
+			}
+		}
+		if err := packedFileScanner.Err(); err != nil {
+			log.Printf("[ERROR] Error unpack file %v from archive %v (error: %v)", packedFile.Name, filename, err)
+			var limitError *ArchiveLimitError
+			if !errors.As(err, &limitError) {
+				err = &StatusError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("%v:%d: %v", packedFile.Name, lineNumber+1, err)}
+			}
+			return err
+		}
+		for recordHash, count := range entryRecords {
+			archiveRecords[recordHash] = max(archiveRecords[recordHash], count)
+		}
+	}
+	if result.DuplicatesSuppressed > 0 {
+		log.Printf("[INFO] %d duplicate records suppressed in archive %v", result.DuplicatesSuppressed, filename)
+	}
+	if result.LinesRejected > 0 {
+		log.Printf("[WARN] %d lines of archive %v rejected", result.LinesRejected, filename)
+	}
+	if result.LinesSpooled > 0 {
+		log.Printf("[WARN] %d lines of archive %v spooled: %v", result.LinesSpooled, filename, promtailFailure)
+	}
+	return nil
+}
+
+// ingestEntry reports whether the archive entry is one of the log files to push
+func (promtailConfig *MoLogPromtail) ingestEntry(name string) bool {
+	if strings.HasSuffix(name, "/") {
+		return false
+	}
+	for _, pattern := range promtailConfig.ArchiveEntries {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// PromtailError promtail rejected the pushed line as invalid
+type PromtailError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *PromtailError) Error() string {
+	return fmt.Sprintf("promtail rejected line with status %d: %s", err.StatusCode, err.Message)
+}
+
+// pushPromtail sends the request to promtail.
+// Returns *PromtailError when promtail rejects the line, *StatusError with 503 when promtail
+// is unreachable or overloaded and with 502 on promtail failure.
+func pushPromtail(promtailRequest *http.Request) error {
+	started := time.Now()
+	promtailResponse, err := http.DefaultClient.Do(promtailRequest)
+	if err != nil {
+		observePush(started, 0)
+		log.Printf("[ERROR] Failed to POST: %v", err)
+		return &StatusError{Status: http.StatusServiceUnavailable, Err: fmt.Errorf("promtail is unavailable: %v", err)}
+	}
+	defer promtailResponse.Body.Close()
+	observePush(started, promtailResponse.StatusCode)
+	if promtailResponse.StatusCode/100 == 2 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(promtailResponse.Body, 4096))
+	if err != nil {
+		log.Printf("[ERROR] Failed to read response body: %v", err)
+	}
+	message := strings.TrimSpace(string(body))
+	log.Printf("[INFO] status = %d, want = %d, push result %v", promtailResponse.StatusCode, http.StatusNoContent, message)
+	switch {
+	case promtailResponse.StatusCode == http.StatusTooManyRequests || promtailResponse.StatusCode == http.StatusServiceUnavailable:
+		return &StatusError{
+			Status:     http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("promtail is overloaded (status %d): %s", promtailResponse.StatusCode, message),
+			RetryAfter: promtailResponse.Header.Get("Retry-After"),
+		}
+	case promtailResponse.StatusCode == http.StatusBadRequest:
+		return &PromtailError{promtailResponse.StatusCode, message}
+	default:
+		return &StatusError{Status: http.StatusBadGateway, Err: fmt.Errorf("promtail failed (status %d): %s", promtailResponse.StatusCode, message)}
+	}
+}
@@ -16,60 +16,43 @@
 package escape
 
 import (
-	"strings"
-	"sync"
 	"unicode/utf8"
-
-	// Needed to include json vars
-	_ "encoding/json"
-	// Needed to use "go:linkname"
-	_ "unsafe"
 )
 
 const hex = "0123456789abcdef"
 
-var buf = sync.Pool{
-	New: func() interface{} {
-		return new(strings.Builder)
-	},
-}
-
-//go:linkname htmlSafeSet encoding/json.safeSet
-var htmlSafeSet [utf8.RuneSelf]bool
-
-// JSON will escape the string provided into a JSON-like format, respecting all escaping. This will return
-// the string value already in quotes. Acts like (and copied from) 'json.Marshal' on a string value.
-func JSON(s string) string {
-	if len(s) == 0 {
-		return `""`
+// safeSet ASCII characters that need no escaping in a JSON string, all but control characters, " and \
+// (same as safeSet of encoding/json, HTML characters are not escaped).
+var safeSet = func() (set [utf8.RuneSelf]bool) {
+	for b := ' '; b < utf8.RuneSelf; b++ {
+		set[b] = b != '"' && b != '\\'
 	}
-	e := buf.Get().(*strings.Builder)
-	e.Grow(2 + len(s))
-	e.WriteByte('"')
+	return set
+}()
+
+// AppendJSON appends the string in quotes with JSON escaping to the buffer, invalid UTF-8 becomes \ufffd
+func AppendJSON(e []byte, s string) []byte {
+	e = append(e, '"')
 	start := 0
 	for i := 0; i < len(s); {
 		if b := s[i]; b < utf8.RuneSelf {
-			if htmlSafeSet[b] {
+			if safeSet[b] {
 				i++
 				continue
 			}
-			if start < i {
-				e.WriteString(s[start:i])
-			}
-			e.WriteByte('\\')
+			e = append(e, s[start:i]...)
+			e = append(e, '\\')
 			switch b {
 			case '\\', '"':
-				e.WriteByte(b)
+				e = append(e, b)
 			case '\n':
-				e.WriteByte('n')
+				e = append(e, 'n')
 			case '\r':
-				e.WriteByte('r')
+				e = append(e, 'r')
 			case '\t':
-				e.WriteByte('t')
+				e = append(e, 't')
 			default:
-				e.WriteString(`u00`)
-				e.WriteByte(hex[b>>4])
-				e.WriteByte(hex[b&0xF])
+				e = append(e, 'u', '0', '0', hex[b>>4], hex[b&0xF])
 			}
 			i++
 			start = i
@@ -77,32 +60,22 @@ func JSON(s string) string {
 		}
 		c, size := utf8.DecodeRuneInString(s[i:])
 		if c == utf8.RuneError && size == 1 {
-			if start < i {
-				e.WriteString(s[start:i])
-			}
-			e.WriteString(`\ufffd`)
+			e = append(e, s[start:i]...)
+			e = append(e, `\ufffd`...)
 			i += size
 			start = i
 			continue
 		}
 		if c == '\u2028' || c == '\u2029' {
-			if start < i {
-				e.WriteString(s[start:i])
-			}
-			e.WriteString(`\u202`)
-			e.WriteByte(hex[c&0xF])
+			e = append(e, s[start:i]...)
+			e = append(e, `\u202`...)
+			e = append(e, hex[c&0xF])
 			i += size
 			start = i
 			continue
 		}
 		i += size
 	}
-	if start < len(s) {
-		e.WriteString(s[start:])
-	}
-	e.WriteByte('"')
-	r := e.String()
-	e.Reset()
-	buf.Put(e)
-	return r
+	e = append(e, s[start:]...)
+	return append(e, '"')
 }
@@ -0,0 +1,52 @@
+package escape
+
+import (
+	"unicode/utf8"
+)
+
+// LabelName sanitises the name into a valid Loki label name ([a-zA-Z_][a-zA-Z0-9_]*). Invalid characters
+// are replaced by underscores, a leading digit gets an underscore prefix: app-id becomes app_id, 1st becomes _1st.
+func LabelName(name string) string {
+	if validLabelName(name) {
+		return name
+	}
+	return string(AppendLabelName(make([]byte, 0, len(name)+1), name))
+}
+
+// AppendLabelName appends the sanitised label name to the buffer, see LabelName
+func AppendLabelName(e []byte, name string) []byte {
+	if validLabelName(name) {
+		return append(e, name...)
+	}
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		e = append(e, '_')
+	}
+	for i := 0; i < len(name); {
+		if labelNameByte(name[i], 1) {
+			e = append(e, name[i])
+			i++
+			continue
+		}
+		// one underscore per character, not per byte of it
+		_, size := utf8.DecodeRuneInString(name[i:])
+		e = append(e, '_')
+		i += size
+	}
+	return e
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !labelNameByte(name[i], i) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelNameByte(b byte, i int) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (i > 0 && b >= '0' && b <= '9')
+}
@@ -0,0 +1,132 @@
+package escape
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var rexLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func FuzzLabelName(f *testing.F) {
+	for _, name := range []string{"", "app", "app-id", "1st", "über", "a.b.c", "__name__", "\xff", "app_id"} {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		label := LabelName(name)
+		if !rexLabelName.MatchString(label) {
+			t.Fatalf("LabelName(%q) = %q is not a valid label name", name, label)
+		}
+		if rexLabelName.MatchString(name) && label != name {
+			t.Fatalf("LabelName(%q) = %q changed a valid name", name, label)
+		}
+		if again := LabelName(label); again != label {
+			t.Fatalf("LabelName(%q) = %q, sanitised again %q", name, label, again)
+		}
+	})
+}
+
+func FuzzJSON(f *testing.F) {
+	for _, value := range []string{"", "crm", "s\"1", "\\", "\x00\n\r\t", "  \xff", "</script>", "\u2028"} {
+		f.Add(value)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		escaped := AppendJSON(nil, value)
+		if !json.Valid(escaped) {
+			t.Fatalf("AppendJSON(%q) = %s is invalid JSON", value, escaped)
+		}
+		var decoded string
+		if err := json.Unmarshal(escaped, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if utf8.ValidString(value) && decoded != value {
+			t.Fatalf("AppendJSON(%q) decodes to %q", value, decoded)
+		}
+	})
+}
+
+func FuzzPushWriter(f *testing.F) {
+	f.Add("app-id", "crm", "app_id", "evil", "00:09:58:068__FINE_____SplitLogger |***File handlers initialized", "session", "s\"1", int64(1703279398068000000))
+	f.Add("", "", "_", "\\", "\x00\n\r\t  \xff", "1st", "</script>", int64(0))
+	f.Add("level", "FINE", "level", "INFO", "", "level", "x", int64(-1))
+	f.Fuzz(func(t *testing.T, name1, value1, name2, value2, line, metadataName, metadataValue string, nanoseconds int64) {
+		w := NewPushWriter()
+		defer w.Release()
+		w.Label(name1, value1)
+		w.Label(name2, value2)
+		w.Value(time.Unix(0, nanoseconds), line, map[string]string{metadataName: metadataValue, name1: value1})
+		body := w.Bytes()
+		if !json.Valid(body) {
+			t.Fatalf("invalid JSON: %s", body)
+		}
+		if err := checkKeys(json.NewDecoder(strings.NewReader(string(body)))); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+
+		var push struct {
+			Streams []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][]json.RawMessage
+			} `json:"streams"`
+		}
+		if err := json.Unmarshal(body, &push); err != nil {
+			t.Fatal(err)
+		}
+		stream := push.Streams[0]
+		for name := range stream.Stream {
+			if !rexLabelName.MatchString(name) {
+				t.Fatalf("invalid label name %q: %s", name, body)
+			}
+		}
+		if got := stream.Stream[LabelName(name1)]; utf8.ValidString(value1) && got != value1 {
+			t.Fatalf("first label %q = %q, want %q", LabelName(name1), got, value1)
+		}
+		var timestamp, decodedLine string
+		json.Unmarshal(stream.Values[0][0], &timestamp)
+		json.Unmarshal(stream.Values[0][1], &decodedLine)
+		if timestamp != fmt.Sprint(nanoseconds) {
+			t.Fatalf("timestamp %s, want %d", timestamp, nanoseconds)
+		}
+		if utf8.ValidString(line) && decodedLine != line {
+			t.Fatalf("line %q, want %q", decodedLine, line)
+		}
+	})
+}
+
+// checkKeys reads one JSON value, objects must not have duplicate keys
+func checkKeys(decoder *json.Decoder) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		keys := make(map[string]bool)
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			if keys[key.(string)] {
+				return fmt.Errorf("duplicate key %q", key)
+			}
+			keys[key.(string)] = true
+			if err := checkKeys(decoder); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	case json.Delim('['):
+		for decoder.More() {
+			if err := checkKeys(decoder); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package escape
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Buffers grown beyond this (huge lines) are not kept in the pool
+const maxPooledPushSize = 1 << 20
+
+// State of the push body, labels of the stream are followed by its values
+const (
+	pushStateLabels = iota
+	pushStateValues
+	pushStateClosed
+)
+
+var pushWriters = sync.Pool{
+	New: func() interface{} {
+		return &PushWriter{buf: make([]byte, 0, 1024)}
+	},
+}
+
+// PushWriter writes the JSON body of a Loki push request of one stream into a pooled buffer:
+//
+//	{"streams":[{"stream":{"label":"value"},"values":[["<unix nanoseconds>","line",{"metadata":"value"}]]}]}
+//
+// Label names are sanitised, names and values are escaped. Of labels or metadata sanitised to the same name
+// the first one is written, the body never has duplicate keys.
+type PushWriter struct {
+	buf   []byte
+	state int
+	names [][2]int // positions of the written names in buf, of the labels or the metadata of the last value
+}
+
+// NewPushWriter push writer of the pool, Release returns it
+func NewPushWriter() *PushWriter {
+	w := pushWriters.Get().(*PushWriter)
+	w.Reset()
+	return w
+}
+
+// Release returns the writer to the pool, its bytes must not be used anymore
+func (w *PushWriter) Release() {
+	if cap(w.buf) > maxPooledPushSize {
+		return
+	}
+	pushWriters.Put(w)
+}
+
+// Reset starts a new push body
+func (w *PushWriter) Reset() {
+	w.buf = append(w.buf[:0], `{"streams":[{"stream":{`...)
+	w.state = pushStateLabels
+	w.names = w.names[:0]
+}
+
+// appendName appends the quoted sanitised name with the separator, false (nothing appended) when the name
+// is already written
+func (w *PushWriter) appendName(name string) bool {
+	mark := len(w.buf)
+	if len(w.names) > 0 {
+		w.buf = append(w.buf, ',')
+	}
+	w.buf = append(w.buf, '"')
+	start := len(w.buf)
+	w.buf = AppendLabelName(w.buf, name)
+	end := len(w.buf)
+	for _, written := range w.names {
+		if bytes.Equal(w.buf[written[0]:written[1]], w.buf[start:end]) {
+			w.buf = w.buf[:mark]
+			return false
+		}
+	}
+	w.names = append(w.names, [2]int{start, end})
+	w.buf = append(w.buf, '"', ':')
+	return true
+}
+
+// Label adds a label of the stream, labels must be written before the values
+func (w *PushWriter) Label(name string, value string) {
+	if w.state != pushStateLabels {
+		panic("escape: label written after the values of the stream")
+	}
+	if w.appendName(name) {
+		w.buf = AppendJSON(w.buf, value)
+	}
+}
+
+// Value adds the log line at the timestamp with its structured metadata (may be nil)
+func (w *PushWriter) Value(timestamp time.Time, line string, metadata map[string]string) {
+	switch w.state {
+	case pushStateLabels:
+		w.buf = append(w.buf, `},"values":[`...)
+		w.state = pushStateValues
+	case pushStateValues:
+		w.buf = append(w.buf, ',')
+	default:
+		panic("escape: value written to a closed push body")
+	}
+	// nanoseconds since the epoch as a decimal string
+	w.buf = append(w.buf, '[', '"')
+	w.buf = strconv.AppendInt(w.buf, timestamp.UnixNano(), 10)
+	w.buf = append(w.buf, '"', ',')
+	w.buf = AppendJSON(w.buf, line)
+	if len(metadata) > 0 {
+		w.buf = append(w.buf, ',', '{')
+		w.names = w.names[:0]
+		for name, value := range metadata {
+			if w.appendName(name) {
+				w.buf = AppendJSON(w.buf, value)
+			}
+		}
+		w.buf = append(w.buf, '}')
+	}
+	w.buf = append(w.buf, ']')
+}
+
+// Close ends the push body, further labels and values are not allowed
+func (w *PushWriter) Close() {
+	switch w.state {
+	case pushStateLabels:
+		w.buf = append(w.buf, `},"values":[]}]}`...)
+	case pushStateValues:
+		w.buf = append(w.buf, `]}]}`...)
+	}
+	w.state = pushStateClosed
+}
+
+// Bytes closed push body, valid until the writer is reset or released
+func (w *PushWriter) Bytes() []byte {
+	w.Close()
+	return w.buf
+}
+
+// WriteTo writes the closed push body to the writer
+func (w *PushWriter) WriteTo(writer io.Writer) (int64, error) {
+	n, err := writer.Write(w.Bytes())
+	return int64(n), err
+}
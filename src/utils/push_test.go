@@ -0,0 +1,26 @@
+package escape
+
+import (
+	"testing"
+	"time"
+)
+
+var benchmarkLabels = [][2]string{{"env", "prod"}, {"app", "field-service"}, {"device", "d1"}, {"level", "FINE"}, {"source", "SplitLogger"}}
+var benchmarkMetadata = map[string]string{"session": "s1"}
+
+const benchmarkLine = `00:09:58:068__FINE_____SplitLogger              |***File handlers initialized "quoted" path\to`
+
+// BenchmarkPushWriter push body of one line by the pooled writer
+func BenchmarkPushWriter(b *testing.B) {
+	timestamp := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := NewPushWriter()
+		for _, label := range benchmarkLabels {
+			w.Label(label[0], label[1])
+		}
+		w.Value(timestamp, benchmarkLine, benchmarkMetadata)
+		w.Bytes()
+		w.Release()
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ConfigError config problem with its field path and position in the YAML file
+type ConfigError struct {
+	File    string `json:"file"`
+	Path    string `json:"path,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (err *ConfigError) Error() string {
+	location := err.File
+	if err.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", err.File, err.Line, err.Column)
+	}
+	if err.Path == "" {
+		return location + ": " + err.Message
+	}
+	return location + ": " + err.Path + ": " + err.Message
+}
+
+// ConfigErrors all problems of the config file
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Errors of yaml.v2 start with the line number
+var rexYAMLErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// configChecker collects config errors, positions are looked up in the YAML node tree.
+// sources maps paths of a migrated or merged config to the fields of the file they come from.
+// Warnings name settings that are dropped.
+type configChecker struct {
+	file     string
+	root     *yamlv3.Node
+	errors   ConfigErrors
+	warnings []string
+	sources  map[string]fieldSource
+	// files the config refers to may not exist yet (config not written yet), missing ones are warnings
+	pendingFiles bool
+}
+
+// fieldSource path of the field in the file of the checker, nil checker is the file itself
+type fieldSource struct {
+	checker *configChecker
+	path    []interface{}
+}
+
+func newConfigChecker(file string, content []byte) *configChecker {
+	checker := &configChecker{file: file}
+	var document yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &document); err == nil && len(document.Content) > 0 {
+		checker.root = document.Content[0]
+	}
+	return checker
+}
+
+// yamlError adds errors of yaml.Unmarshal, one per line of the message
+func (checker *configChecker) yamlError(err error) {
+	message := strings.TrimPrefix(err.Error(), "yaml: unmarshal errors:\n")
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line)
+		if subMatch := rexYAMLErrorLine.FindStringSubmatch(line); subMatch != nil {
+			lineNumber, _ := strconv.Atoi(subMatch[1])
+			checker.errors = append(checker.errors, &ConfigError{File: checker.file, Line: lineNumber, Column: 1, Message: subMatch[2]})
+		} else if line != "" {
+			checker.errors = append(checker.errors, &ConfigError{File: checker.file, Message: line})
+		}
+	}
+}
+
+// add adds the error of the field, path elements are map keys (string) and sequence indexes (int)
+func (checker *configChecker) add(fieldPath []interface{}, format string, args ...interface{}) {
+	source, fieldPath := checker.source(fieldPath)
+	configError := &ConfigError{
+		File:    source.file,
+		Path:    formatFieldPath(fieldPath),
+		Message: fmt.Sprintf(format, args...),
+	}
+	if node := source.node(fieldPath); node != nil {
+		configError.Line = node.Line
+		configError.Column = node.Column
+	}
+	checker.errors = append(checker.errors, configError)
+}
+
+// source checker of the file the field comes from and the path of the field there,
+// the longest mapped prefix of a migrated or merged config is replaced
+func (checker *configChecker) source(fieldPath []interface{}) (*configChecker, []interface{}) {
+	for i := len(fieldPath); i > 0; i-- {
+		if source, exists := checker.sources[formatFieldPath(fieldPath[:i])]; exists {
+			sourcePath := append(source.path[:len(source.path):len(source.path)], fieldPath[i:]...)
+			if source.checker != nil && source.checker != checker {
+				return source.checker.source(sourcePath)
+			}
+			return checker, sourcePath
+		}
+	}
+	return checker, fieldPath
+}
+
+// origin file the field comes from
+func (checker *configChecker) origin(fieldPath []interface{}) string {
+	source, _ := checker.source(fieldPath)
+	return source.file
+}
+
+// definedIn names the file of the first definition when the field is defined again in another file
+func (checker *configChecker) definedIn(firstPath []interface{}, fieldPath []interface{}) string {
+	if firstPath == nil {
+		return ""
+	}
+	if first := checker.origin(firstPath); first != checker.origin(fieldPath) {
+		return " in " + first
+	}
+	return ""
+}
+
+// sortErrors orders errors by file, in the order the files are first reported, and by position in the file
+func (checker *configChecker) sortErrors() {
+	fileOrder := make(map[string]int)
+	for _, err := range checker.errors {
+		if _, exists := fileOrder[err.File]; !exists {
+			fileOrder[err.File] = len(fileOrder)
+		}
+	}
+	// the checked file comes first, whatever was found first
+	fileOrder[checker.file] = -1
+	sort.SliceStable(checker.errors, func(i, j int) bool {
+		if checker.errors[i].File != checker.errors[j].File {
+			return fileOrder[checker.errors[i].File] < fileOrder[checker.errors[j].File]
+		}
+		return checker.errors[i].Line < checker.errors[j].Line
+	})
+}
+
+// node the node of the field or of its nearest defined parent
+func (checker *configChecker) node(fieldPath []interface{}) *yamlv3.Node {
+	node := checker.root
+	for _, element := range fieldPath {
+		if node == nil {
+			return nil
+		}
+		var next *yamlv3.Node
+		switch element := element.(type) {
+		case string:
+			if node.Kind == yamlv3.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == element {
+						next = node.Content[i+1]
+					}
+				}
+			}
+		case int:
+			if node.Kind == yamlv3.SequenceNode && element < len(node.Content) {
+				next = node.Content[element]
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
+
+func formatFieldPath(fieldPath []interface{}) string {
+	var builder strings.Builder
+	for _, element := range fieldPath {
+		switch element := element.(type) {
+		case int:
+			fmt.Fprintf(&builder, "[%d]", element)
+		default:
+			if builder.Len() > 0 {
+				builder.WriteString(".")
+			}
+			fmt.Fprintf(&builder, "%v", element)
+		}
+	}
+	return builder.String()
+}
+
+// missingFile reports the missing file the config refers to, a warning when files are pending
+func (checker *configChecker) missingFile(fieldPath []interface{}, format string, args ...interface{}) {
+	if !checker.pendingFiles {
+		checker.add(fieldPath, format, args...)
+		return
+	}
+	checker.warnings = append(checker.warnings, fmt.Sprintf("%s: %s, create it before molog is started", formatFieldPath(fieldPath), fmt.Sprintf(format, args...)))
+}
+
+// err all collected errors, nil when there are none
+func (checker *configChecker) err() error {
+	if len(checker.errors) == 0 {
+		return nil
+	}
+	return checker.errors
+}
+
+// CheckConfig validates the config file without opening stores or listening
+func CheckConfig(filename string) error {
+	_, err := loadMoLog(filename, false)
+	return err
+}
+
+// checkConfigContent validates the config content of the file before it is written, certificates it
+// refers to may be created later, warnings name the missing ones
+func checkConfigContent(filename string, content []byte) ([]string, error) {
+	var warnings []string
+	_, err := buildMoLog(filename, content, false, &warnings)
+	return warnings, err
+}